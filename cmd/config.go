@@ -0,0 +1,68 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// configCmd group the configuration file commands
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Configuration file commands",
+}
+
+// configValidateCmd check a configuration file without starting the proxy
+var configValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Validate a configuration file, the --iptv-proxy-config one or the default one when not given",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		file := viper.ConfigFileUsed()
+		if len(args) > 0 {
+			file = args[0]
+		}
+		if file == "" {
+			fmt.Fprintln(os.Stderr, "no configuration file found")
+			os.Exit(1)
+		}
+
+		if _, err := config.LoadFile(file); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			var errs config.Errors
+			if errors.As(err, &errs) {
+				fmt.Fprintf(os.Stderr, "%d error(s)\n", len(errs))
+			}
+			os.Exit(1)
+		}
+
+		fmt.Printf("%s: valid\n", file)
+	},
+}
+
+func init() {
+	configCmd.AddCommand(configValidateCmd)
+	rootCmd.AddCommand(configCmd)
+}
@@ -0,0 +1,66 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
+	"github.com/spf13/cobra"
+)
+
+// hashPasswordCmd print the hash of a password, to use as password in the config file
+var hashPasswordCmd = &cobra.Command{
+	Use:   "hash-password [password]",
+	Short: "Hash a password for the proxy users, read from stdin when not given",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var password string
+		if len(args) > 0 {
+			password = args[0]
+		} else {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("reading the password: %w", err)
+			}
+			password = strings.TrimRight(line, "\r\n")
+		}
+
+		algorithm, err := cmd.Flags().GetString("algorithm")
+		if err != nil {
+			return err
+		}
+
+		hash, err := users.HashPassword(password, algorithm)
+		if err != nil {
+			return err
+		}
+		fmt.Println(hash)
+
+		return nil
+	},
+}
+
+func init() {
+	hashPasswordCmd.Flags().String("algorithm", users.Bcrypt, "Hash algorithm: bcrypt or argon2")
+	rootCmd.AddCommand(hashPasswordCmd)
+}
@@ -20,12 +20,12 @@ package cmd
 
 import (
 	"fmt"
-	"log"
 	"net/url"
 	"os"
 	"strings"
 
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
 
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/server"
 
@@ -41,10 +41,27 @@ var rootCmd = &cobra.Command{
 	Use:   "iptv-proxy",
 	Short: "Reverse proxy on iptv m3u file and xtream codes server api",
 	Run: func(cmd *cobra.Command, args []string) {
+		if file := viper.ConfigFileUsed(); file != "" {
+			if _, err := config.LoadFile(file); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+
+		level, err := logger.ParseLevel(viper.GetString("log-level"))
+		if err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+		l, err := logger.New(os.Stderr, level, viper.GetString("log-format"))
+		if err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+		logger.SetDefault(l)
+
 		m3uURL := viper.GetString("m3u-url")
 		remoteHostURL, err := url.Parse(m3uURL)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("invalid m3u url", "error", err)
 		}
 
 		xtreamUser := viper.GetString("xtream-user")
@@ -59,14 +76,126 @@ var rootCmd = &cobra.Command{
 
 		if xtreamBaseURL == "" && xtreamPassword == "" && xtreamUser == "" {
 			if username != "" && password != "" {
-				log.Printf("[iptv-proxy] INFO: It's seams you are using an Xtream provider!")
-
 				xtreamUser = username
 				xtreamPassword = password
 				xtreamBaseURL = fmt.Sprintf("%s://%s", remoteHostURL.Scheme, remoteHostURL.Host)
-				log.Printf("[iptv-proxy] INFO: xtream service enable with xtream base url: %q xtream username: %q xtream password: %q", xtreamBaseURL, xtreamUser, xtreamPassword)
+				logger.Info("xtream provider detected, xtream service enabled", "base_url", xtreamBaseURL)
+			}
+		}
+
+		var m3uSources []config.M3USource
+		if m3uURL != "" {
+			m3uSources = append(m3uSources, config.M3USource{
+				URL:             m3uURL,
+				RefreshInterval: viper.GetInt("m3u-refresh-interval"),
+			})
+		}
+
+		var extraSources []config.M3USource
+		if err := viper.UnmarshalKey("m3u-sources", &extraSources); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+		for i, s := range extraSources {
+			if s.Name == "" || s.URL == "" {
+				logger.Fatal("m3u-sources: name and url are required for each source")
+			}
+			if s.RefreshInterval == 0 {
+				extraSources[i].RefreshInterval = viper.GetInt("m3u-refresh-interval")
 			}
 		}
+		m3uSources = append(m3uSources, extraSources...)
+
+		var epgSources []config.EPGSource
+		if err := viper.UnmarshalKey("epg-sources", &epgSources); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var listeners []config.Listener
+		if err := viper.UnmarshalKey("listeners", &listeners); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var xtreamProviders []config.XtreamProvider
+		if xtreamBaseURL != "" {
+			xtreamProviders = append(xtreamProviders, config.XtreamProvider{
+				BaseURL:  xtreamBaseURL,
+				User:     config.CredentialString(xtreamUser),
+				Password: config.CredentialString(xtreamPassword),
+			})
+		}
+
+		var extraProviders []config.XtreamProvider
+		if err := viper.UnmarshalKey("xtream-providers", &extraProviders); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+		for _, p := range extraProviders {
+			if p.Name == "" || p.BaseURL == "" {
+				logger.Fatal("xtream-providers: name and base-url are required for each provider")
+			}
+		}
+		xtreamProviders = append(xtreamProviders, extraProviders...)
+
+		var filters []config.FilterRule
+		if err := viper.UnmarshalKey("filters", &filters); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var rewrites []config.RewriteRule
+		if err := viper.UnmarshalKey("rewrites", &rewrites); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var order config.ChannelOrder
+		if err := viper.UnmarshalKey("order", &order); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var numbering config.ChannelNumbering
+		if err := viper.UnmarshalKey("numbering", &numbering); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var dedup config.Dedup
+		if err := viper.UnmarshalKey("dedup", &dedup); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var failover config.Failover
+		if err := viper.UnmarshalKey("failover", &failover); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		// the alternates and the backups are only used by the m3u streams
+		if len(m3uSources) == 0 && (dedup.Mode == "failover" || failover.Timeout > 0 || len(failover.Backups) > 0) {
+			logger.Fatal("failover: the streams failover only applies to the m3u sources")
+		}
+
+		var connections config.ConnectionLimits
+		if err := viper.UnmarshalKey("connections", &connections); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		// the --user and --password account, unless the accounts are in the config file
+		var accounts []config.UserAccount
+		if err := viper.UnmarshalKey("users", &accounts); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+		if len(accounts) == 0 {
+			accounts = []config.UserAccount{{
+				Username: viper.GetString("user"),
+				Password: config.CredentialString(viper.GetString("password")),
+			}}
+		}
+
+		var streamTokens config.StreamTokens
+		if err := viper.UnmarshalKey("stream-tokens", &streamTokens); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
+
+		var access config.AccessControl
+		if err := viper.UnmarshalKey("access", &access); err != nil {
+			logger.Fatal("configuration", "error", err)
+		}
 
 		conf := &config.ProxyConfig{
 			HostConfig: &config.HostConfiguration{
@@ -74,35 +203,96 @@ var rootCmd = &cobra.Command{
 				Port:     viper.GetInt("port"),
 			},
 			RemoteURL:            remoteHostURL,
+			M3USources:           m3uSources,
+			Filters:              filters,
+			Rewrites:             rewrites,
+			Order:                order,
+			Numbering:            numbering,
+			Dedup:                dedup,
+			Failover:             failover,
+			StreamMux:            viper.GetBool("stream-mux"),
+			Connections:          connections,
 			XtreamUser:           config.CredentialString(xtreamUser),
 			XtreamPassword:       config.CredentialString(xtreamPassword),
 			XtreamBaseURL:        xtreamBaseURL,
+			XtreamProviders:      xtreamProviders,
+			EPGSources:           epgSources,
 			M3UCacheExpiration:   viper.GetInt("m3u-cache-expiration"),
 			User:                 config.CredentialString(viper.GetString("user")),
 			Password:             config.CredentialString(viper.GetString("password")),
+			Users:                accounts,
+			StreamTokens:         streamTokens,
+			Access:               access,
 			AdvertisedPort:       viper.GetInt("advertised-port"),
 			HTTPS:                viper.GetBool("https"),
 			M3UFileName:          viper.GetString("m3u-file-name"),
 			CustomEndpoint:       viper.GetString("custom-endpoint"),
 			CustomId:             viper.GetString("custom-id"),
+			TrackIDsFile:         viper.GetString("track-ids-file"),
+			ChannelOverridesFile: viper.GetString("channel-overrides-file"),
+			UsageFile:            viper.GetString("usage-file"),
+			Metrics:              viper.GetBool("metrics"),
+			MetricsChannels:      viper.GetBool("metrics-channels"),
+			ShutdownGrace:        viper.GetInt("shutdown-grace"),
+			GracefulRestart:      viper.GetBool("graceful-restart"),
+			TLSCert:              viper.GetString("tls-cert"),
+			TLSKey:               viper.GetString("tls-key"),
+			TLSPort:              viper.GetInt("tls-port"),
 			XtreamGenerateApiGet: viper.GetBool("xtream-api-get"),
 		}
 
+		if len(listeners) > 0 {
+			applyListeners(conf, listeners)
+		}
+
+		if (conf.TLSCert == "") != (conf.TLSKey == "") {
+			logger.Fatal("tls-cert and tls-key must be set together")
+		}
+		// without a plain http listener the urls are https
+		if conf.TLSCert != "" && conf.TLSPort == 0 {
+			conf.HTTPS = true
+		}
+
 		if conf.AdvertisedPort == 0 {
 			conf.AdvertisedPort = conf.HostConfig.Port
 		}
 
 		server, err := server.NewServer(conf)
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatal("server initialization", "error", err)
 		}
 
 		if e := server.Serve(); e != nil {
-			log.Fatal(e)
+			logger.Fatal("server", "error", e)
 		}
 	},
 }
 
+// applyListeners replace the port and tls settings by the listeners of the configuration file,
+// a plain http and an https listener at most.
+func applyListeners(conf *config.ProxyConfig, listeners []config.Listener) {
+	conf.TLSCert, conf.TLSKey, conf.TLSPort = "", "", 0
+
+	var plain bool
+	for _, l := range listeners {
+		if l.TLSCert == "" {
+			conf.HostConfig.Port = l.Port
+			plain = true
+		}
+	}
+	for _, l := range listeners {
+		if l.TLSCert == "" {
+			continue
+		}
+		conf.TLSCert, conf.TLSKey = l.TLSCert, l.TLSKey
+		if plain {
+			conf.TLSPort = l.Port
+		} else {
+			conf.HostConfig.Port = l.Port
+		}
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -118,25 +308,39 @@ func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
-	rootCmd.PersistentFlags().StringVar(&cfgFile, "iptv-proxy-config", "C", "Config file (default is $HOME/.iptv-proxy.yaml)")
+	rootCmd.PersistentFlags().StringVar(&cfgFile, "iptv-proxy-config", "", "Config file in YAML or TOML (default is .iptv-proxy.yaml in $HOME or the current directory)")
 	rootCmd.Flags().StringP("m3u-url", "u", "", `Iptv m3u file or url e.g: "http://example.com/iptv.m3u"`)
 	rootCmd.Flags().StringP("m3u-file-name", "", "iptv.m3u", `Name of the new proxified m3u file e.g "http://poxy.com/iptv.m3u"`)
 	rootCmd.Flags().StringP("custom-endpoint", "", "", `Custom endpoint "http://poxy.com/<custom-endpoint>/iptv.m3u"`)
 	rootCmd.Flags().StringP("custom-id", "", "", `Custom anti-collison ID for each track "http://proxy.com/<custom-id>/..."`)
+	rootCmd.Flags().String("track-ids-file", "", "File to persist the tracks identifiers, keeping the proxyfied urls stable across restarts")
+	rootCmd.Flags().String("channel-overrides-file", "", "File to persist the channels changes made from the dashboard")
+	rootCmd.Flags().String("usage-file", "", "File to persist the bandwidth and watch time counters of the users")
+	rootCmd.Flags().Bool("metrics", false, "Expose the Prometheus metrics on /metrics, to the admin accounts")
+	rootCmd.Flags().Bool("metrics-channels", false, "Add the bytes streamed by channel to the metrics, one series per channel watched")
+	rootCmd.Flags().String("log-level", "info", "Log level: debug, info, warn or error")
+	rootCmd.Flags().String("log-format", logger.FormatText, "Log format: text (logfmt) or json")
+	rootCmd.Flags().Int("shutdown-grace", 30, "Seconds given to the streams in progress to end on SIGTERM/SIGINT before being cut")
+	rootCmd.Flags().Bool("graceful-restart", false, "On SIGUSR2, start a new iptv-proxy process on the same listening socket and drain this one")
 	rootCmd.Flags().Int("port", 8080, "Iptv-proxy listening port")
 	rootCmd.Flags().Int("advertised-port", 0, "Port to expose the IPTV file and xtream (by default, it's taking value from port) useful to put behind a reverse proxy")
 	rootCmd.Flags().String("hostname", "", "Hostname or IP to expose the IPTVs endpoints")
 	rootCmd.Flags().BoolP("https", "", false, "Activate https for urls proxy")
+	rootCmd.Flags().String("tls-cert", "", "TLS certificate file to serve https, reloaded when it changes or on SIGHUP")
+	rootCmd.Flags().String("tls-key", "", "TLS private key file of the certificate")
+	rootCmd.Flags().Int("tls-port", 0, "Serve https on this port and plain http on --port (by default, https replaces http on --port)")
 	rootCmd.Flags().String("user", "usertest", "User auth to access proxy (m3u/xtream)")
 	rootCmd.Flags().String("password", "passwordtest", "Password auth to access proxy (m3u/xtream)")
 	rootCmd.Flags().String("xtream-user", "", "Xtream-code user login")
 	rootCmd.Flags().String("xtream-password", "", "Xtream-code password login")
 	rootCmd.Flags().String("xtream-base-url", "", "Xtream-code base url e.g(http://expample.tv:8080)")
 	rootCmd.Flags().Int("m3u-cache-expiration", 1, "M3U cache expiration in hour")
+	rootCmd.Flags().Int("m3u-refresh-interval", 0, "Reload the m3u playlist every N minutes (0 to disable)")
+	rootCmd.Flags().Bool("stream-mux", false, "Share one upstream connection between the viewers of a same live channel")
 	rootCmd.Flags().BoolP("xtream-api-get", "", false, "Generate get.php from xtream API instead of get.php original endpoint")
 
 	if e := viper.BindPFlags(rootCmd.Flags()); e != nil {
-		log.Fatal("error binding PFlags to viper")
+		logger.Fatal("error binding PFlags to viper")
 	}
 }
 
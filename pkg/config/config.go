@@ -20,6 +20,7 @@ package config
 
 import (
 	"net/url"
+	"strings"
 )
 
 // CredentialString represents an iptv-proxy credential.
@@ -41,19 +42,201 @@ type HostConfiguration struct {
 	Port     int
 }
 
+// M3USource is an upstream m3u playlist, from an url or a local file.
+type M3USource struct {
+	Name string
+	URL  string
+	// RefreshInterval in minute, 0 for the m3u-refresh-interval
+	RefreshInterval int `mapstructure:"refresh-interval"`
+	// User and Password for basic auth on the playlist url
+	User, Password CredentialString
+	// MaxConnections to the hosts of the source streams, 0 for no limit
+	MaxConnections int `mapstructure:"max-connections"`
+}
+
+// XtreamProvider is an upstream Xtream-code service.
+type XtreamProvider struct {
+	Name           string
+	BaseURL        string `mapstructure:"base-url"`
+	User, Password CredentialString
+	// MaxConnections override the provider account limit, 0 to use it and -1 for no limit
+	MaxConnections int `mapstructure:"max-connections"`
+}
+
+// FilterRule include or exclude the playlist tracks matching it.
+type FilterRule struct {
+	// Action is "include" or "exclude"
+	Action string
+	// Field is "name" for the track name or a tag name e.g: "group-title", "tvg-id"
+	Field string
+	// Match is "exact" (default), "glob" or "regex"
+	Match string
+	Value string
+}
+
+// RewriteRule modify the name or the tags of the playlist tracks.
+type RewriteRule struct {
+	// Field, Match and Value is the optional condition on the tracks to rewrite, see FilterRule.
+	Field string
+	Match string
+	Value string
+	// Action is "replace", "set", "override" or "remove"
+	Action string
+	// Target is "name" for the track name or a tag name
+	Target string
+	// Pattern is the regex replaced by Replacement with the "replace" action
+	Pattern string
+	// Replacement is the new value for the "replace", "set" and "override" actions
+	Replacement string
+}
+
+// ChannelOrder is the order of the playlist tracks.
+type ChannelOrder struct {
+	// Field identifying the channels, "name" (default) or a tag name e.g: "tvg-id"
+	Field string
+	// Channels listed first, in this order
+	Channels []string
+	// Groups priority, the groups not listed keep their upstream order
+	Groups []string
+	// Sort within a group: "" for the upstream order or "alphabetical"
+	Sort string
+}
+
+// PinnedChannel is a channel with a fixed number.
+type PinnedChannel struct {
+	// Value of the ChannelOrder field identifying the channel
+	Value  string
+	Number int
+}
+
+// ChannelNumbering define the channels numbers.
+type ChannelNumbering struct {
+	// Start number of the automatic numbering, 0 to disable
+	Start  int
+	Pinned []PinnedChannel
+}
+
+// Dedup define how the variants of a channel are collapsed.
+type Dedup struct {
+	// By "name" or "tvg-id", empty to disable
+	By string
+	// Mode "best" or "failover"
+	Mode string
+	// Qualities preference, best first
+	Qualities []string
+}
+
+// ChannelBackup attach backup stream URLs to the tracks matching the rule.
+type ChannelBackup struct {
+	Field string
+	// Match type: exact (default), glob or regex
+	Match string
+	Value string
+	URLs  []string
+}
+
+// ConnectionLimits define what happens when a provider account has no connection left.
+type ConnectionLimits struct {
+	// Policy reject (default), queue or preempt
+	Policy string
+	// QueueTimeout in seconds a queued stream waits for a connection
+	QueueTimeout int `mapstructure:"queue-timeout"`
+}
+
+// Failover define how the streams switch to their alternative URLs.
+type Failover struct {
+	// Timeout in seconds without data before trying the next URL, 0 to disable
+	Timeout int
+	Backups []ChannelBackup
+}
+
+// UserAccount is an account of the proxy.
+type UserAccount struct {
+	Username string
+	Password CredentialString
+	Disabled bool
+	// Expiry date e.g: 2024-12-31, empty for never
+	Expiry string
+	// AllowedGroups the user can watch, empty for all
+	AllowedGroups []string `mapstructure:"allowed-groups"`
+	// MaxStreams the user can watch at the same time, 0 for no limit
+	MaxStreams int `mapstructure:"max-streams"`
+	// DailyQuota and MonthlyQuota in MB, 0 for no limit
+	DailyQuota   int64 `mapstructure:"daily-quota"`
+	MonthlyQuota int64 `mapstructure:"monthly-quota"`
+	// Priority of the user streams with the preempt policy, the lowest are stopped first
+	Priority int
+	// Admin can use the admin API
+	Admin bool
+}
+
+// StreamTokens replace the passwords in the streams urls by signed tokens.
+type StreamTokens struct {
+	Enabled bool
+	// Secret signing the tokens, random at each start when empty
+	Secret string
+	// TTL of the tokens in hours
+	TTL int
+	// Strict refuse the passwords in the streams urls
+	Strict bool
+}
+
+// AccessControl restrict the clients of the proxy.
+type AccessControl struct {
+	// Allow and Deny lists of CIDR, with an allow list the other addresses are refused
+	Allow, Deny []string
+	// TrustedProxies CIDR whose X-Forwarded-For header gives the client address
+	TrustedProxies []string `mapstructure:"trusted-proxies"`
+	// MaxFailures of authentication before a client is locked out, 0 to disable
+	MaxFailures int `mapstructure:"max-failures"`
+	// Lockout in seconds, doubled at each new lockout of the client
+	Lockout int
+}
+
 // ProxyConfig Contain original m3u playlist and HostConfiguration
 type ProxyConfig struct {
 	HostConfig           *HostConfiguration
 	XtreamUser           CredentialString
 	XtreamPassword       CredentialString
 	XtreamBaseURL        string
+	XtreamProviders      []XtreamProvider
+	EPGSources           []EPGSource
 	XtreamGenerateApiGet bool
 	M3UCacheExpiration   int
 	M3UFileName          string
 	CustomEndpoint       string
 	CustomId             string
+	TrackIDsFile         string
+	ChannelOverridesFile string
+	UsageFile            string
+	Metrics              bool
+	MetricsChannels      bool
+	ShutdownGrace        int
+	GracefulRestart      bool
+	TLSCert, TLSKey      string
+	TLSPort              int
 	RemoteURL            *url.URL
+	M3USources           []M3USource
+	Filters              []FilterRule
+	Rewrites             []RewriteRule
+	Order                ChannelOrder
+	Numbering            ChannelNumbering
+	Dedup                Dedup
+	Failover             Failover
+	StreamMux            bool
+	Connections          ConnectionLimits
 	AdvertisedPort       int
 	HTTPS                bool
 	User, Password       CredentialString
+	Users                []UserAccount
+	StreamTokens         StreamTokens
+	Access               AccessControl
+}
+
+// XtreamGetAuto tells if the m3u url is the get.php playlist of the Xtream provider,
+// the playlist being then served by the Xtream get.php handler.
+func (c *ProxyConfig) XtreamGetAuto() bool {
+	return c.XtreamBaseURL != "" && c.RemoteURL != nil && strings.Contains(c.XtreamBaseURL, c.RemoteURL.Host) &&
+		c.XtreamUser.String() == c.RemoteURL.Query().Get("username") &&
+		c.XtreamPassword.String() == c.RemoteURL.Query().Get("password")
 }
@@ -0,0 +1,84 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+// Listener is an address the proxy listens on, serving https with a certificate.
+type Listener struct {
+	Port    int
+	TLSCert string `mapstructure:"tls-cert"`
+	TLSKey  string `mapstructure:"tls-key"`
+}
+
+// EPGSource is an XMLTV guide, from an url or a local file, gzipped or not.
+type EPGSource struct {
+	Name string
+	URL  string
+}
+
+// File is the schema of the configuration file, in YAML or TOML.
+// The keys are the mapstructure tags, or the lowercased field names.
+// The settings are also available as flags and environment variables, except the lists and the sections.
+type File struct {
+	// Settings
+	M3UURL               string `mapstructure:"m3u-url"`
+	M3UFileName          string `mapstructure:"m3u-file-name"`
+	M3UCacheExpiration   int    `mapstructure:"m3u-cache-expiration"`
+	M3URefreshInterval   int    `mapstructure:"m3u-refresh-interval"`
+	CustomEndpoint       string `mapstructure:"custom-endpoint"`
+	CustomID             string `mapstructure:"custom-id"`
+	TrackIDsFile         string `mapstructure:"track-ids-file"`
+	ChannelOverridesFile string `mapstructure:"channel-overrides-file"`
+	UsageFile            string `mapstructure:"usage-file"`
+	Metrics              bool
+	MetricsChannels      bool   `mapstructure:"metrics-channels"`
+	LogLevel             string `mapstructure:"log-level"`
+	LogFormat            string `mapstructure:"log-format"`
+	ShutdownGrace        int    `mapstructure:"shutdown-grace"`
+	GracefulRestart      bool   `mapstructure:"graceful-restart"`
+	Port                 int
+	AdvertisedPort       int `mapstructure:"advertised-port"`
+	Hostname             string
+	HTTPS                bool
+	TLSCert              string `mapstructure:"tls-cert"`
+	TLSKey               string `mapstructure:"tls-key"`
+	TLSPort              int    `mapstructure:"tls-port"`
+	User                 string
+	Password             string
+	XtreamUser           string `mapstructure:"xtream-user"`
+	XtreamPassword       string `mapstructure:"xtream-password"`
+	XtreamBaseURL        string `mapstructure:"xtream-base-url"`
+	XtreamAPIGet         bool   `mapstructure:"xtream-api-get"`
+	StreamMux            bool   `mapstructure:"stream-mux"`
+
+	// Sections
+	Listeners       []Listener
+	M3USources      []M3USource      `mapstructure:"m3u-sources"`
+	XtreamProviders []XtreamProvider `mapstructure:"xtream-providers"`
+	EPGSources      []EPGSource      `mapstructure:"epg-sources"`
+	Filters         []FilterRule
+	Rewrites        []RewriteRule
+	Order           ChannelOrder
+	Numbering       ChannelNumbering
+	Dedup           Dedup
+	Failover        Failover
+	Connections     ConnectionLimits
+	Users           []UserAccount
+	StreamTokens    StreamTokens `mapstructure:"stream-tokens"`
+	Access          AccessControl
+}
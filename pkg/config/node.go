@@ -0,0 +1,223 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pelletier/go-toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Types of the scalar nodes.
+const (
+	tagString = "string"
+	tagInt    = "integer"
+	tagFloat  = "float"
+	tagBool   = "boolean"
+	tagTime   = "date"
+	tagNull   = "null"
+)
+
+// node is a value of the configuration file with its line, whatever the file format.
+type node struct {
+	line int
+	// scalar value and type, when not a mapping nor a list
+	tag   string
+	value string
+	// mapping keys and values
+	keys    []*node
+	mapping bool
+	// mapping values or list items
+	items []*node
+	list  bool
+}
+
+// decoded return the value of the node as decoded from the file.
+func (n *node) decoded() interface{} {
+	switch {
+	case n.mapping:
+		m := make(map[string]interface{}, len(n.keys))
+		for i, k := range n.keys {
+			m[k.value] = n.items[i].decoded()
+		}
+		return m
+	case n.list:
+		l := make([]interface{}, 0, len(n.items))
+		for _, item := range n.items {
+			l = append(l, item.decoded())
+		}
+		return l
+	}
+
+	switch n.tag {
+	case tagInt:
+		if i, err := strconv.ParseInt(n.value, 0, 64); err == nil {
+			return i
+		}
+	case tagBool:
+		if b, err := strconv.ParseBool(n.value); err == nil {
+			return b
+		}
+	case tagNull:
+		return nil
+	}
+
+	return n.value
+}
+
+// parseYAML convert a YAML document into nodes.
+func parseYAML(b []byte) (*node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &node{line: 1, mapping: true}, nil
+	}
+
+	return fromYAML(doc.Content[0]), nil
+}
+
+func fromYAML(y *yaml.Node) *node {
+	n := &node{line: y.Line}
+
+	switch y.Kind {
+	case yaml.AliasNode:
+		return fromYAML(y.Alias)
+	case yaml.MappingNode:
+		n.mapping = true
+		var merged []*node
+		explicit := map[string]bool{}
+		for i := 0; i+1 < len(y.Content); i += 2 {
+			key, value := y.Content[i], y.Content[i+1]
+			if key.ShortTag() == "!!merge" {
+				if m := fromYAML(value); m.list {
+					merged = append(merged, m.items...)
+				} else {
+					merged = append(merged, m)
+				}
+				continue
+			}
+			n.keys = append(n.keys, &node{line: key.Line, tag: tagString, value: key.Value})
+			n.items = append(n.items, fromYAML(value))
+			explicit[key.Value] = true
+		}
+		// the entries of the merged mappings are inlined, unless overridden
+		for _, m := range merged {
+			for i, k := range m.keys {
+				if !explicit[k.value] {
+					n.keys = append(n.keys, k)
+					n.items = append(n.items, m.items[i])
+				}
+			}
+		}
+	case yaml.SequenceNode:
+		n.list = true
+		for _, item := range y.Content {
+			n.items = append(n.items, fromYAML(item))
+		}
+	default:
+		n.value = y.Value
+		switch y.ShortTag() {
+		case "!!int":
+			n.tag = tagInt
+		case "!!float":
+			n.tag = tagFloat
+		case "!!bool":
+			n.tag = tagBool
+		case "!!timestamp":
+			n.tag = tagTime
+		case "!!null":
+			n.tag = tagNull
+		default:
+			n.tag = tagString
+		}
+	}
+
+	return n
+}
+
+// parseTOML convert a TOML document into nodes.
+func parseTOML(b []byte) (*node, error) {
+	tree, err := toml.LoadBytes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	n := fromTOMLTree(tree)
+	n.line = 1
+
+	return n, nil
+}
+
+func fromTOMLTree(tree *toml.Tree) *node {
+	n := &node{line: tree.Position().Line, mapping: true}
+
+	keys := tree.Keys()
+	positions := make(map[string]int, len(keys))
+	for _, k := range keys {
+		positions[k] = tree.GetPositionPath([]string{k}).Line
+	}
+	sort.Slice(keys, func(i, j int) bool { return positions[keys[i]] < positions[keys[j]] })
+
+	for _, k := range keys {
+		line := positions[k]
+		n.keys = append(n.keys, &node{line: line, tag: tagString, value: k})
+		n.items = append(n.items, fromTOML(tree.GetPath([]string{k}), line))
+	}
+
+	return n
+}
+
+func fromTOML(v interface{}, line int) *node {
+	switch v := v.(type) {
+	case *toml.Tree:
+		return fromTOMLTree(v)
+	case []*toml.Tree:
+		n := &node{line: line, list: true}
+		for _, t := range v {
+			n.items = append(n.items, fromTOMLTree(t))
+		}
+		return n
+	case []interface{}:
+		n := &node{line: line, list: true}
+		for _, item := range v {
+			n.items = append(n.items, fromTOML(item, line))
+		}
+		return n
+	case string:
+		return &node{line: line, tag: tagString, value: v}
+	case int64:
+		return &node{line: line, tag: tagInt, value: strconv.FormatInt(v, 10)}
+	case float64:
+		return &node{line: line, tag: tagFloat, value: strconv.FormatFloat(v, 'g', -1, 64)}
+	case bool:
+		return &node{line: line, tag: tagBool, value: strconv.FormatBool(v)}
+	case time.Time:
+		return &node{line: line, tag: tagTime, value: v.Format(time.RFC3339)}
+	case toml.LocalDate, toml.LocalDateTime, toml.LocalTime:
+		return &node{line: line, tag: tagTime, value: fmt.Sprint(v)}
+	}
+
+	return &node{line: line, tag: tagNull}
+}
@@ -0,0 +1,527 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+)
+
+// Error is an invalid entry of the configuration file.
+type Error struct {
+	File string
+	// Line of the entry, 0 when unknown
+	Line int
+	// Path of the entry e.g: users[1].password
+	Path string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.File)
+	if e.Line > 0 {
+		fmt.Fprintf(&b, ":%d", e.Line)
+	}
+	if e.Path != "" {
+		fmt.Fprintf(&b, ": %s", e.Path)
+	}
+	fmt.Fprintf(&b, ": %s", e.Msg)
+
+	return b.String()
+}
+
+// Errors are all the invalid entries of a configuration file, in the file order.
+type Errors []*Error
+
+func (e Errors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "\n")
+}
+
+// LoadFile read and validate a YAML (or JSON) or TOML configuration file.
+// The unknown keys and the values of the wrong type are reported together as Errors
+// with their line, then the invalid settings.
+func LoadFile(path string) (*File, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root *node
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		root, err = parseYAML(b)
+	case ".toml":
+		root, err = parseTOML(b)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration format, expected .yaml, .yml, .json or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	v := &validator{file: path, lines: map[string]int{}}
+	v.check(root, reflect.TypeOf(File{}), "")
+	if len(v.errs) > 0 {
+		return nil, v.errs
+	}
+
+	var f File
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		WeaklyTypedInput: true,
+		Result:           &f,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := decoder.Decode(root.decoded()); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	v.validate(&f)
+	if len(v.errs) > 0 {
+		sort.SliceStable(v.errs, func(i, j int) bool { return v.errs[i].Line < v.errs[j].Line })
+		return nil, v.errs
+	}
+
+	return &f, nil
+}
+
+// validator collect the errors of a configuration file.
+type validator struct {
+	file string
+	errs Errors
+	// lines of the entries by path
+	lines map[string]int
+}
+
+func (v *validator) errorf(line int, path, format string, args ...interface{}) {
+	v.errs = append(v.errs, &Error{File: v.file, Line: line, Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// fail report an error on an entry, at the line of its closest parent when it's missing.
+func (v *validator) fail(path, format string, args ...interface{}) {
+	p := path
+	for {
+		if line, ok := v.lines[p]; ok {
+			v.errorf(line, path, format, args...)
+			return
+		}
+		i := strings.LastIndexAny(p, ".[")
+		if i < 0 {
+			v.errorf(0, path, format, args...)
+			return
+		}
+		p = p[:i]
+	}
+}
+
+func (v *validator) has(path string) bool {
+	_, ok := v.lines[path]
+	return ok
+}
+
+// keyName return the key of a field in the configuration file, as decoded by viper.
+func keyName(f reflect.StructField) string {
+	if tag := f.Tag.Get("mapstructure"); tag != "" {
+		return tag
+	}
+
+	return strings.ToLower(f.Name)
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+
+	return path + "." + key
+}
+
+// check the structure of the file and the types of its values against the schema.
+func (v *validator) check(n *node, t reflect.Type, path string) {
+	v.lines[path] = n.line
+	if !n.mapping && !n.list && n.tag == tagNull {
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if !n.mapping {
+			v.errorf(n.line, path, "expected a mapping")
+			return
+		}
+		fields := make(map[string]reflect.Type, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			fields[keyName(t.Field(i))] = t.Field(i).Type
+		}
+		seen := make(map[string]bool, len(n.keys))
+		for i, k := range n.keys {
+			p := join(path, k.value)
+			ft, ok := fields[k.value]
+			switch {
+			case !ok:
+				v.errorf(k.line, p, "unknown key")
+			case seen[k.value]:
+				v.errorf(k.line, p, "duplicated key")
+			default:
+				v.check(n.items[i], ft, p)
+			}
+			seen[k.value] = true
+		}
+	case reflect.Slice:
+		if !n.list {
+			v.errorf(n.line, path, "expected a list")
+			return
+		}
+		for i, item := range n.items {
+			v.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.String:
+		// a string written as a number is fine, not as a float or a boolean which would be rewritten
+		if n.mapping || n.list || n.tag == tagFloat || n.tag == tagBool {
+			v.errorf(n.line, path, "expected a string, quote the value")
+		}
+	case reflect.Int, reflect.Int64:
+		if n.mapping || n.list || n.tag != tagInt {
+			v.errorf(n.line, path, "expected an integer")
+		}
+	case reflect.Bool:
+		if n.mapping || n.list || n.tag != tagBool {
+			v.errorf(n.line, path, "expected a boolean (true or false)")
+		}
+	}
+}
+
+// Values accepted by the settings, see the playlist, server and logger packages.
+var (
+	matchTypes     = []string{"", "exact", "glob", "regex"}
+	filterActions  = []string{"include", "exclude"}
+	rewriteActions = []string{"replace", "set", "override", "remove"}
+	orderSorts     = []string{"", "alphabetical"}
+	dedupKeys      = []string{"", "name", "tvg-id"}
+	dedupModes     = []string{"", "best", "failover"}
+	policies       = []string{"", "reject", "queue", "preempt"}
+	logFormats     = []string{"", logger.FormatText, logger.FormatJSON}
+)
+
+// validate the values of the settings.
+func (v *validator) validate(f *File) {
+	if f.LogLevel != "" {
+		if _, err := logger.ParseLevel(f.LogLevel); err != nil {
+			v.fail("log-level", "expected debug, info, warn or error")
+		}
+	}
+	v.oneOf("log-format", f.LogFormat, logFormats)
+	v.port("port", f.Port)
+	v.port("advertised-port", f.AdvertisedPort)
+	v.port("tls-port", f.TLSPort)
+	v.positive("shutdown-grace", f.ShutdownGrace)
+	v.positive("m3u-cache-expiration", f.M3UCacheExpiration)
+	v.positive("m3u-refresh-interval", f.M3URefreshInterval)
+	if (f.TLSCert == "") != (f.TLSKey == "") {
+		p := "tls-key"
+		if f.TLSKey == "" {
+			p = "tls-cert"
+		}
+		v.fail(p, "tls-cert and tls-key must be set together")
+	}
+	if f.M3UURL != "" {
+		v.url("m3u-url", f.M3UURL, false)
+	}
+	if f.XtreamBaseURL != "" {
+		v.url("xtream-base-url", f.XtreamBaseURL, true)
+	}
+
+	v.validateListeners(f)
+
+	names := map[string]bool{}
+	for i, s := range f.M3USources {
+		p := fmt.Sprintf("m3u-sources[%d]", i)
+		v.name(p, s.Name, names)
+		if v.required(p+".url", s.URL) {
+			v.url(p+".url", s.URL, false)
+		}
+		v.positive(p+".refresh-interval", s.RefreshInterval)
+		v.positive(p+".max-connections", s.MaxConnections)
+	}
+
+	names = map[string]bool{}
+	for i, x := range f.XtreamProviders {
+		p := fmt.Sprintf("xtream-providers[%d]", i)
+		v.name(p, x.Name, names)
+		if v.required(p+".base-url", x.BaseURL) {
+			v.url(p+".base-url", x.BaseURL, true)
+		}
+		if x.MaxConnections < -1 {
+			v.fail(p+".max-connections", "expected -1 for no limit, 0 for the account limit or a limit")
+		}
+	}
+
+	names = map[string]bool{}
+	for i, e := range f.EPGSources {
+		p := fmt.Sprintf("epg-sources[%d]", i)
+		v.name(p, e.Name, names)
+		if v.required(p+".url", e.URL) {
+			v.url(p+".url", e.URL, false)
+		}
+	}
+
+	for i, r := range f.Filters {
+		p := fmt.Sprintf("filters[%d]", i)
+		if v.required(p+".action", r.Action) {
+			v.oneOf(p+".action", r.Action, filterActions)
+		}
+		v.required(p+".field", r.Field)
+		v.match(p, r.Match, r.Value)
+	}
+
+	for i, r := range f.Rewrites {
+		p := fmt.Sprintf("rewrites[%d]", i)
+		if r.Field != "" {
+			v.match(p, r.Match, r.Value)
+		}
+		v.required(p+".target", r.Target)
+		if v.required(p+".action", r.Action) && v.oneOf(p+".action", r.Action, rewriteActions) {
+			switch {
+			case r.Action == "replace":
+				v.regex(p+".pattern", r.Pattern)
+			case r.Action == "remove" && r.Target == "name":
+				v.fail(p+".target", "the track name can't be removed")
+			}
+		}
+	}
+
+	v.oneOf("order.sort", f.Order.Sort, orderSorts)
+	v.positive("numbering.start", f.Numbering.Start)
+	for i, pin := range f.Numbering.Pinned {
+		p := fmt.Sprintf("numbering.pinned[%d]", i)
+		v.required(p+".value", pin.Value)
+		if pin.Number <= 0 {
+			v.fail(p+".number", "expected a number greater than 0")
+		}
+	}
+
+	v.oneOf("dedup.by", f.Dedup.By, dedupKeys)
+	v.oneOf("dedup.mode", f.Dedup.Mode, dedupModes)
+
+	v.positive("failover.timeout", f.Failover.Timeout)
+	for i, b := range f.Failover.Backups {
+		p := fmt.Sprintf("failover.backups[%d]", i)
+		v.required(p+".field", b.Field)
+		v.match(p, b.Match, b.Value)
+		if len(b.URLs) == 0 {
+			v.fail(p+".urls", "required")
+		}
+	}
+
+	// the alternates and the backups are only used by the m3u streams
+	if f.M3UURL == "" && len(f.M3USources) == 0 && (f.XtreamBaseURL != "" || len(f.XtreamProviders) > 0) {
+		if f.Dedup.Mode == "failover" {
+			v.fail("dedup.mode", "failover only applies to the m3u sources, use best with the Xtream providers")
+		}
+		if v.has("failover") {
+			v.fail("failover", "the streams failover only applies to the m3u sources")
+		}
+	}
+
+	v.oneOf("connections.policy", f.Connections.Policy, policies)
+	v.positive("connections.queue-timeout", f.Connections.QueueTimeout)
+
+	names = map[string]bool{}
+	for i, u := range f.Users {
+		p := fmt.Sprintf("users[%d]", i)
+		if v.required(p+".username", u.Username) {
+			if names[u.Username] {
+				v.fail(p+".username", "duplicated user %q", u.Username)
+			}
+			names[u.Username] = true
+		}
+		v.required(p+".password", u.Password.String())
+		if u.Expiry != "" {
+			if _, err := time.Parse("2006-01-02", u.Expiry); err != nil {
+				if _, err := time.Parse(time.RFC3339, u.Expiry); err != nil {
+					v.fail(p+".expiry", "invalid date %q, expected e.g: 2024-12-31", u.Expiry)
+				}
+			}
+		}
+		v.positive(p+".max-streams", u.MaxStreams)
+		v.positive(p+".daily-quota", int(u.DailyQuota))
+		v.positive(p+".monthly-quota", int(u.MonthlyQuota))
+	}
+
+	v.positive("stream-tokens.ttl", f.StreamTokens.TTL)
+
+	for _, list := range []struct {
+		key   string
+		cidrs []string
+	}{
+		{"access.allow", f.Access.Allow},
+		{"access.deny", f.Access.Deny},
+		{"access.trusted-proxies", f.Access.TrustedProxies},
+	} {
+		for i, s := range list.cidrs {
+			if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+				v.fail(fmt.Sprintf("%s[%d]", list.key, i), "invalid address or CIDR %q", s)
+			}
+		}
+	}
+	v.positive("access.max-failures", f.Access.MaxFailures)
+	v.positive("access.lockout", f.Access.Lockout)
+}
+
+// validateListeners check there is at most a plain http and an https listener,
+// which replace the port and tls settings.
+func (v *validator) validateListeners(f *File) {
+	if len(f.Listeners) == 0 {
+		return
+	}
+	for _, key := range []string{"port", "tls-port", "tls-cert", "tls-key"} {
+		if v.has(key) {
+			v.fail(key, "can't be set with listeners")
+		}
+	}
+
+	var plain, secure bool
+	ports := map[int]bool{}
+	for i, l := range f.Listeners {
+		p := fmt.Sprintf("listeners[%d]", i)
+		if l.Port <= 0 || l.Port > 65535 {
+			v.fail(p+".port", "expected a port between 1 and 65535")
+		} else if ports[l.Port] {
+			v.fail(p+".port", "duplicated port %d", l.Port)
+		}
+		ports[l.Port] = true
+
+		if (l.TLSCert == "") != (l.TLSKey == "") {
+			v.fail(p+".tls-key", "tls-cert and tls-key must be set together")
+		}
+		if l.TLSCert != "" {
+			if secure {
+				v.fail(p, "only one https listener is supported")
+			}
+			secure = true
+		} else {
+			if plain {
+				v.fail(p, "only one http listener is supported")
+			}
+			plain = true
+		}
+	}
+}
+
+// required report an empty value, it returns false when it's empty.
+func (v *validator) required(path, value string) bool {
+	if value == "" {
+		v.fail(path, "required")
+		return false
+	}
+
+	return true
+}
+
+// name check the name of a list entry is set and unique.
+func (v *validator) name(path, name string, names map[string]bool) {
+	if !v.required(path+".name", name) {
+		return
+	}
+	if names[name] {
+		v.fail(path+".name", "duplicated name %q", name)
+	}
+	names[name] = true
+}
+
+func (v *validator) oneOf(path, value string, allowed []string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+
+	names := make([]string, 0, len(allowed))
+	for _, a := range allowed {
+		if a != "" {
+			names = append(names, a)
+		}
+	}
+	v.fail(path, "unknown value %q, expected %s", value, strings.Join(names, ", "))
+
+	return false
+}
+
+func (v *validator) positive(path string, n int) {
+	if n < 0 {
+		v.fail(path, "expected a positive value")
+	}
+}
+
+func (v *validator) port(path string, port int) {
+	if port < 0 || port > 65535 {
+		v.fail(path, "expected a port up to 65535")
+	}
+}
+
+// match check the match type of a rule and compile its value.
+func (v *validator) match(path, matchType, value string) {
+	if !v.oneOf(path+".match", matchType, matchTypes) {
+		return
+	}
+	if matchType == "regex" {
+		v.regex(path+".value", value)
+	}
+}
+
+func (v *validator) regex(path, expr string) {
+	if _, err := regexp.Compile(expr); err != nil {
+		v.fail(path, "invalid regex: %v", err)
+	}
+}
+
+// url check an upstream url, or a local file when http isn't required.
+func (v *validator) url(path, s string, http bool) {
+	u, err := url.Parse(s)
+	if err != nil {
+		v.fail(path, "invalid url: %v", err)
+		return
+	}
+	switch {
+	case u.Scheme == "http" || u.Scheme == "https":
+		if u.Host == "" {
+			v.fail(path, "missing host in %q", s)
+		}
+	case http:
+		v.fail(path, "expected an http or https url")
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package config
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files of the testdata")
+
+// TestLoadFileGolden compare the errors reported for each configuration file
+// of the testdata to its .golden file, "valid" for a valid file.
+func TestLoadFileGolden(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range files {
+		if filepath.Ext(file) == ".golden" {
+			continue
+		}
+
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			got := "valid\n"
+			if _, err := LoadFile(file); err != nil {
+				got = err.Error() + "\n"
+			}
+
+			golden := file + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, []byte(got), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != string(want) {
+				t.Errorf("LoadFile(%s) =\n%s\nwant\n%s", file, got, want)
+			}
+		})
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	_, err := LoadFile("testdata/values.yaml")
+
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("LoadFile() = %v, want Errors", err)
+	}
+	for i := 1; i < len(errs); i++ {
+		if errs[i].Line < errs[i-1].Line {
+			t.Errorf("errors not in the file order, line %d after %d", errs[i].Line, errs[i-1].Line)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package logger implements the leveled and structured logs of the proxy,
+// written as logfmt or JSON with the credentials redacted.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level of a log entry.
+type Level int
+
+// Log levels.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel parse a level name.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// Log formats.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Logger write log entries made of a message and key/value pairs.
+// It is safe for concurrent use.
+type Logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// output is shared by a logger and the loggers derived from it.
+type output struct {
+	sync.Mutex
+	w      io.Writer
+	level  Level
+	format string
+}
+
+// New return a logger writing the entries from level in format.
+func New(w io.Writer, level Level, format string) (*Logger, error) {
+	switch format {
+	case "", FormatText:
+		format = FormatText
+	case FormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+
+	return &Logger{out: &output{w: w, level: level, format: format}}, nil
+}
+
+// With return a logger adding the key/value pairs to each entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled tell if the entries of level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+// Debug write a debug entry.
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+// Info write an info entry.
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+// Warn write a warning entry.
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+// Error write an error entry.
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// Log write an entry of level.
+func (l *Logger) Log(level Level, msg string, kv ...interface{}) {
+	l.log(level, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	pairs = append(pairs, "time", time.Now().Format(time.RFC3339), "level", level.String(), "msg", msg)
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, kv...)
+
+	var line []byte
+	if l.out.format == FormatJSON {
+		line = formatJSON(pairs)
+	} else {
+		line = formatText(pairs)
+	}
+
+	l.out.Lock()
+	defer l.out.Unlock()
+
+	l.out.w.Write(line) // nolint: errcheck
+}
+
+// field return the key and the redacted value of the pair at i,
+// a missing value or a key which isn't a string being reported as such.
+func field(pairs []interface{}, i int) (string, interface{}) {
+	key, ok := pairs[i].(string)
+	if !ok {
+		key = "!badkey"
+	}
+	if i+1 >= len(pairs) {
+		return key, "!missing"
+	}
+
+	switch v := pairs[i+1].(type) {
+	case nil:
+		return key, nil
+	case bool, int, int64, uint64, float64:
+		return key, v
+	case time.Duration:
+		return key, v.String()
+	case time.Time:
+		return key, v.Format(time.RFC3339)
+	case error:
+		return key, Redact(v.Error())
+	case fmt.Stringer:
+		return key, Redact(v.String())
+	default:
+		return key, Redact(fmt.Sprint(v))
+	}
+}
+
+func formatText(pairs []interface{}) []byte {
+	var b strings.Builder
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		key, v := field(pairs, i)
+		b.WriteString(key)
+		b.WriteByte('=')
+
+		s := fmt.Sprint(v)
+		if v == nil {
+			s = ""
+		}
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+			s = strconv.Quote(s)
+		}
+		b.WriteString(s)
+	}
+	b.WriteByte('\n')
+
+	return []byte(b.String())
+}
+
+func formatJSON(pairs []interface{}) []byte {
+	entry := make(map[string]interface{}, len(pairs)/2)
+	keys := make([]string, 0, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		key, v := field(pairs, i)
+		if _, ok := entry[key]; !ok {
+			keys = append(keys, key)
+		}
+		entry[key] = v
+	}
+
+	// the keys in their order, the time, level and message first
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, key := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.Write(marshal(key))
+		b.WriteByte(':')
+		b.Write(marshal(entry[key]))
+	}
+	b.WriteString("}\n")
+
+	return []byte(b.String())
+}
+
+// marshal encode v in JSON without escaping the HTML characters of the urls.
+func marshal(v interface{}) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return marshal(err.Error())
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+}
+
+var (
+	defaultLock      sync.RWMutex
+	defaultLogger, _ = New(os.Stderr, LevelInfo, FormatText)
+)
+
+// Default return the logger of the proxy.
+func Default() *Logger {
+	defaultLock.RLock()
+	defer defaultLock.RUnlock()
+
+	return defaultLogger
+}
+
+// SetDefault replace the logger of the proxy.
+func SetDefault(l *Logger) {
+	defaultLock.Lock()
+	defer defaultLock.Unlock()
+
+	defaultLogger = l
+}
+
+// With return the default logger adding the key/value pairs to each entry.
+func With(kv ...interface{}) *Logger {
+	return Default().With(kv...)
+}
+
+// Debug write a debug entry with the default logger.
+func Debug(msg string, kv ...interface{}) {
+	Default().log(LevelDebug, msg, kv)
+}
+
+// Info write an info entry with the default logger.
+func Info(msg string, kv ...interface{}) {
+	Default().log(LevelInfo, msg, kv)
+}
+
+// Warn write a warning entry with the default logger.
+func Warn(msg string, kv ...interface{}) {
+	Default().log(LevelWarn, msg, kv)
+}
+
+// Error write an error entry with the default logger.
+func Error(msg string, kv ...interface{}) {
+	Default().log(LevelError, msg, kv)
+}
+
+// Fatal write an error entry with the default logger and exit.
+func Fatal(msg string, kv ...interface{}) {
+	Default().log(LevelError, msg, kv)
+	os.Exit(1)
+}
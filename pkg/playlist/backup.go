@@ -0,0 +1,72 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"fmt"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+type backup struct {
+	matcher *matcher
+	urls    []string
+}
+
+// Backups is a compiled set of channel backup rules.
+type Backups struct {
+	backups []backup
+}
+
+// NewBackups compile channel backup rules.
+func NewBackups(rules []config.ChannelBackup) (*Backups, error) {
+	b := &Backups{}
+
+	for i, rule := range rules {
+		m, err := newMatcher(rule.Field, rule.Match, rule.Value)
+		if err != nil {
+			return nil, fmt.Errorf("backup %d: %w", i, err)
+		}
+
+		if len(rule.URLs) == 0 {
+			return nil, fmt.Errorf("backup %d: missing urls", i)
+		}
+
+		b.backups = append(b.backups, backup{matcher: m, urls: rule.URLs})
+	}
+
+	return b, nil
+}
+
+// URLs return the backup URLs of a track, in the rules order.
+func (b *Backups) URLs(track *m3u.Track) []string {
+	if b == nil {
+		return nil
+	}
+
+	var urls []string
+	for _, backup := range b.backups {
+		if backup.matcher.matches(track) {
+			urls = append(urls, backup.urls...)
+		}
+	}
+
+	return urls
+}
@@ -0,0 +1,184 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// Dedup keys.
+const (
+	DedupByName  = "name"
+	DedupByTvgID = "tvg-id"
+)
+
+// Dedup modes.
+const (
+	// DedupBest only keeps the preferred variant of a channel.
+	DedupBest = "best"
+	// DedupFailover keeps the preferred variant and falls back to the others at stream time.
+	DedupFailover = "failover"
+)
+
+// DefaultQualities is the default quality preference, best first.
+var DefaultQualities = []string{"4K", "UHD", "FHD", "HD", "SD"}
+
+var bracketedRegex = regexp.MustCompile(`\|[^|]*\||\[[^\]]*\]`)
+
+// Deduplicator groups the variants of a channel, e.g: its SD/HD/FHD versions.
+type Deduplicator struct {
+	by        string
+	mode      string
+	qualities []string
+	quality   *regexp.Regexp
+}
+
+// NewDeduplicator compile the dedup configuration, it returns nil when dedup is disabled.
+func NewDeduplicator(dedup config.Dedup) (*Deduplicator, error) {
+	if dedup.By == "" {
+		return nil, nil
+	}
+
+	d := &Deduplicator{
+		by:        dedup.By,
+		mode:      dedup.Mode,
+		qualities: dedup.Qualities,
+	}
+
+	switch d.by {
+	case DedupByName, DedupByTvgID:
+	default:
+		return nil, fmt.Errorf("dedup: unknown key %q", d.by)
+	}
+
+	switch d.mode {
+	case "":
+		d.mode = DedupBest
+	case DedupBest, DedupFailover:
+	default:
+		return nil, fmt.Errorf("dedup: unknown mode %q", d.mode)
+	}
+
+	if len(d.qualities) == 0 {
+		d.qualities = DefaultQualities
+	}
+
+	tokens := make([]string, 0, len(d.qualities))
+	for _, q := range d.qualities {
+		tokens = append(tokens, regexp.QuoteMeta(q))
+	}
+	d.quality = regexp.MustCompile(`(?i)(?:^|[^\pL\pN])(` + strings.Join(tokens, "|") + `)(?:[^\pL\pN]|$)`)
+
+	return d, nil
+}
+
+// Failover tell if the other variants are used as fallbacks.
+func (d *Deduplicator) Failover() bool {
+	return d != nil && d.mode == DedupFailover
+}
+
+// Groups return, for each channel, the index of its preferred variant and the indexes
+// of its other variants ordered by preference. Channels keep the position of their first variant.
+func (d *Deduplicator) Groups(tracks []m3u.Track) (keep []int, alternates [][]int) {
+	if d == nil {
+		keep = make([]int, len(tracks))
+		for i := range keep {
+			keep[i] = i
+		}
+		return keep, make([][]int, len(tracks))
+	}
+
+	groups := map[string]int{}
+	var variants [][]int
+	for i := range tracks {
+		key := d.key(&tracks[i])
+		g, ok := groups[key]
+		if !ok {
+			g = len(variants)
+			groups[key] = g
+			variants = append(variants, nil)
+		}
+		variants[g] = append(variants[g], i)
+	}
+
+	keep = make([]int, 0, len(variants))
+	alternates = make([][]int, 0, len(variants))
+	for _, v := range variants {
+		sort.SliceStable(v, func(i, j int) bool {
+			return d.rank(&tracks[v[i]]) < d.rank(&tracks[v[j]])
+		})
+		keep = append(keep, v[0])
+		alternates = append(alternates, v[1:])
+	}
+
+	return keep, alternates
+}
+
+func (d *Deduplicator) key(track *m3u.Track) string {
+	if d.by == DedupByTvgID {
+		if id := Field(track, "tvg-id"); id != "" {
+			return "tvg-id:" + strings.ToLower(id)
+		}
+	}
+
+	return "name:" + d.normalize(track.Name)
+}
+
+// normalize remove the qualities, the bracketed parts e.g: "|UK|"
+// and the symbols of a channel name.
+func (d *Deduplicator) normalize(name string) string {
+	name = bracketedRegex.ReplaceAllString(name, " ")
+	// a match consumes its separators, adjacent qualities e.g: "UHD/4K" need another pass
+	for {
+		n := d.quality.ReplaceAllString(name, " ")
+		if n == name {
+			break
+		}
+		name = n
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) || unicode.Is(unicode.Lm, r)
+	})
+
+	return strings.Join(words, " ")
+}
+
+// rank of the track quality, lower is better.
+func (d *Deduplicator) rank(track *m3u.Track) int {
+	m := d.quality.FindStringSubmatch(track.Name)
+	if m == nil {
+		return len(d.qualities)
+	}
+
+	for i, q := range d.qualities {
+		if strings.EqualFold(q, m[1]) {
+			return i
+		}
+	}
+
+	return len(d.qualities)
+}
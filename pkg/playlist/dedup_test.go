@@ -0,0 +1,156 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestDeduplicatorGroups(t *testing.T) {
+	tracks := []m3u.Track{
+		newTrack("|UK| BBC One SD", "tvg-id", "bbc1"),
+		newTrack("CNN"),
+		newTrack("|UK| BBC One FHD", "tvg-id", "bbc1"),
+		newTrack("BBC One HD", "tvg-id", "BBC1"),
+		newTrack("cnn [backup]"),
+		newTrack("BBC 1 (4K)"),
+		newTrack("Hdtv News"),
+	}
+
+	tests := []struct {
+		name           string
+		dedup          config.Dedup
+		wantKeep       []int
+		wantAlternates [][]int
+	}{
+		{
+			name:           "disabled",
+			dedup:          config.Dedup{},
+			wantKeep:       []int{0, 1, 2, 3, 4, 5, 6},
+			wantAlternates: [][]int{nil, nil, nil, nil, nil, nil, nil},
+		},
+		{
+			name:           "by name",
+			dedup:          config.Dedup{By: DedupByName},
+			wantKeep:       []int{2, 1, 5, 6},
+			wantAlternates: [][]int{{3, 0}, {4}, {}, {}},
+		},
+		{
+			name:           "by tvg-id, the others by name",
+			dedup:          config.Dedup{By: DedupByTvgID},
+			wantKeep:       []int{2, 1, 5, 6},
+			wantAlternates: [][]int{{3, 0}, {4}, {}, {}},
+		},
+		{
+			name:           "qualities preference, the others are part of the name",
+			dedup:          config.Dedup{By: DedupByName, Qualities: []string{"SD", "HD"}},
+			wantKeep:       []int{0, 1, 2, 5, 6},
+			wantAlternates: [][]int{{3}, {4}, {}, {}, {}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDeduplicator(tt.dedup)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keep, alternates := d.Groups(tracks)
+			if !reflect.DeepEqual(keep, tt.wantKeep) {
+				t.Errorf("Groups() keep = %v, want %v", keep, tt.wantKeep)
+			}
+			if len(alternates) != len(tt.wantAlternates) {
+				t.Fatalf("Groups() alternates = %v, want %v", alternates, tt.wantAlternates)
+			}
+			for i := range alternates {
+				if len(alternates[i]) != len(tt.wantAlternates[i]) ||
+					len(alternates[i]) > 0 && !reflect.DeepEqual(alternates[i], tt.wantAlternates[i]) {
+					t.Errorf("Groups() alternates = %v, want %v", alternates, tt.wantAlternates)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestDeduplicatorNormalize(t *testing.T) {
+	d, err := NewDeduplicator(config.Dedup{By: DedupByName})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"BBC One", "bbc one"},
+		{"|UK| BBC One FHD", "bbc one"},
+		{"[VIP] BBC-One (HD)", "bbc one"},
+		{"BBC One UHD/4K", "bbc one"},
+		{"BBC One HD SD 4K", "bbc one"},
+		{"HDTV", "hdtv"},
+		{"Canal+ Sport", "canal sport"},
+		{"Ｎ１", "ｎ１"},
+	}
+
+	for _, tt := range tests {
+		if got := d.normalize(tt.name); got != tt.want {
+			t.Errorf("normalize(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNewDeduplicator(t *testing.T) {
+	tests := []struct {
+		name         string
+		dedup        config.Dedup
+		wantNil      bool
+		wantErr      bool
+		wantFailover bool
+	}{
+		{name: "disabled", dedup: config.Dedup{Mode: DedupFailover}, wantNil: true},
+		{name: "best by default", dedup: config.Dedup{By: DedupByName}},
+		{name: "failover", dedup: config.Dedup{By: DedupByTvgID, Mode: DedupFailover}, wantFailover: true},
+		{name: "unknown key", dedup: config.Dedup{By: "url"}, wantErr: true},
+		{name: "unknown mode", dedup: config.Dedup{By: DedupByName, Mode: "merge"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := NewDeduplicator(tt.dedup)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewDeduplicator() = %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if (d == nil) != tt.wantNil {
+				t.Errorf("NewDeduplicator() = %v, want nil %v", d, tt.wantNil)
+			}
+			if d.Failover() != tt.wantFailover {
+				t.Errorf("Failover() = %v, want %v", d.Failover(), tt.wantFailover)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"fmt"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// Filter actions.
+const (
+	FilterInclude = "include"
+	FilterExclude = "exclude"
+)
+
+// Filter is a compiled set of filter rules.
+// When there are include rules, a track has to match at least one of them to be kept.
+// A track matching any exclude rule is removed.
+type Filter struct {
+	include []*matcher
+	exclude []*matcher
+}
+
+// NewFilter compile filter rules.
+func NewFilter(rules []config.FilterRule) (*Filter, error) {
+	f := &Filter{}
+
+	for i, rule := range rules {
+		m, err := newMatcher(rule.Field, rule.Match, rule.Value)
+		if err != nil {
+			return nil, fmt.Errorf("filter %d: %w", i, err)
+		}
+
+		switch rule.Action {
+		case FilterInclude:
+			f.include = append(f.include, m)
+		case FilterExclude:
+			f.exclude = append(f.exclude, m)
+		default:
+			return nil, fmt.Errorf("filter %d: unknown action %q", i, rule.Action)
+		}
+	}
+
+	return f, nil
+}
+
+// Keep tell if the track passes the filter.
+func (f *Filter) Keep(track *m3u.Track) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(f.include) > 0 {
+		included := false
+		for _, m := range f.include {
+			if m.matches(track) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, m := range f.exclude {
+		if m.matches(track) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Apply return the tracks passing the filter.
+func (f *Filter) Apply(tracks []m3u.Track) []m3u.Track {
+	if f == nil || (len(f.include) == 0 && len(f.exclude) == 0) {
+		return tracks
+	}
+
+	res := make([]m3u.Track, 0, len(tracks))
+	for i := range tracks {
+		if f.Keep(&tracks[i]) {
+			res = append(res, tracks[i])
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,113 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package playlist implements the transformations applied to the proxyfied playlists.
+package playlist
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jamesnetherton/m3u"
+)
+
+// NameField is the field name matching the track name, other fields are tags names.
+const NameField = "name"
+
+// Match types of a field value.
+const (
+	MatchExact = "exact"
+	MatchGlob  = "glob"
+	MatchRegex = "regex"
+)
+
+// matcher match a track field against a value.
+type matcher struct {
+	field string
+	match func(string) bool
+}
+
+func newMatcher(field, matchType, value string) (*matcher, error) {
+	if field == "" {
+		return nil, fmt.Errorf("missing field")
+	}
+
+	m := &matcher{field: field}
+
+	switch matchType {
+	case "", MatchExact:
+		m.match = func(s string) bool { return s == value }
+	case MatchGlob:
+		re, err := regexp.Compile(globToRegex(value))
+		if err != nil {
+			return nil, fmt.Errorf("glob %q: %w", value, err)
+		}
+		m.match = re.MatchString
+	case MatchRegex:
+		re, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("regex %q: %w", value, err)
+		}
+		m.match = re.MatchString
+	default:
+		return nil, fmt.Errorf("unknown match type %q", matchType)
+	}
+
+	return m, nil
+}
+
+func (m *matcher) matches(track *m3u.Track) bool {
+	return m.match(Field(track, m.field))
+}
+
+// Field return the value of a track field: its name or the value of a tag.
+func Field(track *m3u.Track, field string) string {
+	if field == NameField {
+		return track.Name
+	}
+
+	for _, tag := range track.Tags {
+		if strings.EqualFold(tag.Name, field) {
+			return tag.Value
+		}
+	}
+
+	return ""
+}
+
+// globToRegex convert a glob pattern, where "*" matches any sequence of characters
+// and "?" any single character, to an anchored regular expression.
+func globToRegex(glob string) string {
+	var b strings.Builder
+
+	b.WriteString("^")
+	for _, r := range glob {
+		switch r {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String()
+}
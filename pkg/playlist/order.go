@@ -0,0 +1,257 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// ChannelNumberTag is the tag holding the channel number.
+const ChannelNumberTag = "tvg-chno"
+
+// Sort within a group.
+const (
+	SortNone         = ""
+	SortAlphabetical = "alphabetical"
+)
+
+// Orderer sort the playlist tracks and number them.
+type Orderer struct {
+	field    string
+	channels map[string]int
+	groups   map[string]int
+	sort     string
+
+	start  int
+	pinned map[string]int
+}
+
+// NewOrderer compile the channels order and numbering configuration.
+func NewOrderer(order config.ChannelOrder, numbering config.ChannelNumbering) (*Orderer, error) {
+	o := &Orderer{
+		field:    order.Field,
+		channels: make(map[string]int, len(order.Channels)),
+		groups:   make(map[string]int, len(order.Groups)),
+		sort:     order.Sort,
+		start:    numbering.Start,
+		pinned:   make(map[string]int, len(numbering.Pinned)),
+	}
+	if o.field == "" {
+		o.field = NameField
+	}
+
+	switch o.sort {
+	case SortNone, SortAlphabetical:
+	default:
+		return nil, fmt.Errorf("order: unknown sort %q", o.sort)
+	}
+
+	for i, c := range order.Channels {
+		if _, ok := o.channels[c]; !ok {
+			o.channels[c] = i
+		}
+	}
+	for i, g := range order.Groups {
+		if _, ok := o.groups[g]; !ok {
+			o.groups[g] = i
+		}
+	}
+
+	if o.start < 0 {
+		return nil, fmt.Errorf("numbering: negative start %d", o.start)
+	}
+	used := map[int]string{}
+	for _, p := range numbering.Pinned {
+		if p.Number <= 0 {
+			return nil, fmt.Errorf("numbering: invalid number %d for %q", p.Number, p.Value)
+		}
+		if v, ok := used[p.Number]; ok && v != p.Value {
+			return nil, fmt.Errorf("numbering: number %d pinned to %q and %q", p.Number, v, p.Value)
+		}
+		used[p.Number] = p.Value
+		o.pinned[p.Value] = p.Number
+	}
+
+	return o, nil
+}
+
+// Active tell if the orderer sorts or numbers the tracks.
+func (o *Orderer) Active() bool {
+	return o.sorting() || o.numbering()
+}
+
+func (o *Orderer) sorting() bool {
+	return o != nil && (len(o.channels) > 0 || len(o.groups) > 0 || o.sort != SortNone)
+}
+
+func (o *Orderer) numbering() bool {
+	return o != nil && (o.start > 0 || len(o.pinned) > 0)
+}
+
+// Order return the tracks indexes in the configured order:
+// explicitly ordered channels first, then by group priority,
+// groups not listed keeping their upstream order.
+func (o *Orderer) Order(tracks []m3u.Track) []int {
+	order := make([]int, len(tracks))
+	for i := range order {
+		order[i] = i
+	}
+	if !o.sorting() {
+		return order
+	}
+
+	groupRank := make(map[string]int)
+	for i := range tracks {
+		g := Field(&tracks[i], "group-title")
+		if _, ok := groupRank[g]; ok {
+			continue
+		}
+		if r, ok := o.groups[g]; ok {
+			groupRank[g] = r
+			continue
+		}
+		groupRank[g] = len(o.groups) + len(groupRank)
+	}
+
+	channelRank := func(t *m3u.Track) int {
+		if r, ok := o.channels[Field(t, o.field)]; ok {
+			return r
+		}
+		return len(o.channels)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := &tracks[order[i]], &tracks[order[j]]
+
+		if ra, rb := channelRank(a), channelRank(b); ra != rb {
+			return ra < rb
+		}
+
+		if ga, gb := groupRank[Field(a, "group-title")], groupRank[Field(b, "group-title")]; ga != gb {
+			return ga < gb
+		}
+
+		if o.sort == SortAlphabetical {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+
+		return false
+	})
+
+	return order
+}
+
+// Numbers return the channel number of each track, 0 when not numbered.
+// Pinned channels get their number, the others are numbered in order from
+// the start number, skipping the pinned numbers.
+func (o *Orderer) Numbers(tracks []m3u.Track) []int {
+	if !o.numbering() {
+		return make([]int, len(tracks))
+	}
+
+	return o.numbers(tracks, o.start)
+}
+
+// ChannelNumbers return the channel number of each track like Numbers,
+// but every track is numbered, from 1 when there is no start number.
+func (o *Orderer) ChannelNumbers(tracks []m3u.Track) []int {
+	start := 1
+	if o != nil && o.start > 0 {
+		start = o.start
+	}
+
+	return o.numbers(tracks, start)
+}
+
+func (o *Orderer) numbers(tracks []m3u.Track, start int) []int {
+	var (
+		field  = NameField
+		pinned map[string]int
+	)
+	if o != nil {
+		field, pinned = o.field, o.pinned
+	}
+
+	taken := make(map[int]bool, len(pinned))
+	for _, n := range pinned {
+		taken[n] = true
+	}
+
+	numbers := make([]int, len(tracks))
+	next := start
+	for i := range tracks {
+		if n, ok := pinned[Field(&tracks[i], field)]; ok {
+			numbers[i] = n
+			continue
+		}
+		if start == 0 {
+			continue
+		}
+		for taken[next] {
+			next++
+		}
+		numbers[i] = next
+		next++
+	}
+
+	return numbers
+}
+
+// Sort return the tracks in the configured order and, for each of them, its index in the given tracks.
+func (o *Orderer) Sort(tracks []m3u.Track) ([]m3u.Track, []int) {
+	order := o.Order(tracks)
+	if !o.sorting() {
+		return tracks, order
+	}
+
+	res := make([]m3u.Track, len(tracks))
+	for i, j := range order {
+		res[i] = tracks[j]
+	}
+
+	return res, order
+}
+
+// Apply sort the tracks and set their channel number tag.
+// It returns the sorted tracks and, for each of them, its index in the given tracks.
+func (o *Orderer) Apply(tracks []m3u.Track) ([]m3u.Track, []int) {
+	res, order := o.Sort(tracks)
+	if !o.numbering() {
+		return res, order
+	}
+
+	if !o.sorting() {
+		res = append([]m3u.Track(nil), res...)
+	}
+	for i, n := range o.Numbers(res) {
+		if n == 0 {
+			continue
+		}
+		res[i].Tags = append([]m3u.Tag(nil), res[i].Tags...)
+		SetField(&res[i], ChannelNumberTag, strconv.Itoa(n))
+	}
+
+	return res, order
+}
@@ -0,0 +1,192 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func orderTracks() []m3u.Track {
+	return []m3u.Track{
+		newTrack("CNN", "tvg-id", "cnn", "group-title", "News"),
+		newTrack("bbc two", "tvg-id", "bbc2", "group-title", "UK"),
+		newTrack("Cartoon", "tvg-id", "cartoon", "group-title", "Kids"),
+		newTrack("BBC One", "tvg-id", "bbc1", "group-title", "UK"),
+		newTrack("Al Jazeera", "tvg-id", "aljazeera", "group-title", "News"),
+	}
+}
+
+func TestOrdererOrder(t *testing.T) {
+	tests := []struct {
+		name  string
+		order config.ChannelOrder
+		want  []int
+	}{
+		{"upstream order", config.ChannelOrder{}, []int{0, 1, 2, 3, 4}},
+		{"alphabetical in the groups", config.ChannelOrder{Sort: SortAlphabetical}, []int{4, 0, 3, 1, 2}},
+		{"groups priority", config.ChannelOrder{Groups: []string{"UK", "Kids"}}, []int{1, 3, 2, 0, 4}},
+		{"channels first", config.ChannelOrder{Channels: []string{"BBC One", "CNN"}}, []int{3, 0, 4, 1, 2}},
+		{"channels by tag", config.ChannelOrder{Field: "tvg-id", Channels: []string{"cartoon"}}, []int{2, 0, 4, 1, 3}},
+		{"tracks gathered by group", config.ChannelOrder{Channels: []string{"ABC"}, Groups: []string{"Sports"}}, []int{0, 4, 1, 3, 2}},
+		{
+			"everything",
+			config.ChannelOrder{Channels: []string{"Cartoon"}, Groups: []string{"UK"}, Sort: SortAlphabetical},
+			[]int{2, 3, 1, 4, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOrderer(tt.order, config.ChannelNumbering{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := o.Order(orderTracks()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Order() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrdererNumbers(t *testing.T) {
+	tests := []struct {
+		name      string
+		numbering config.ChannelNumbering
+		field     string
+		want      []int
+	}{
+		{"disabled", config.ChannelNumbering{}, "", []int{0, 0, 0, 0, 0}},
+		{"from start", config.ChannelNumbering{Start: 100}, "", []int{100, 101, 102, 103, 104}},
+		{
+			"pinned numbers skipped",
+			config.ChannelNumbering{Start: 1, Pinned: []config.PinnedChannel{{Value: "BBC One", Number: 2}}},
+			"", []int{1, 3, 4, 2, 5},
+		},
+		{
+			"pinned only",
+			config.ChannelNumbering{Pinned: []config.PinnedChannel{{Value: "cnn", Number: 10}}},
+			"tvg-id", []int{10, 0, 0, 0, 0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOrderer(config.ChannelOrder{Field: tt.field}, tt.numbering)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := o.Numbers(orderTracks()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Numbers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOrdererChannelNumbers(t *testing.T) {
+	tests := []struct {
+		name      string
+		numbering config.ChannelNumbering
+		want      []int
+	}{
+		{"disabled", config.ChannelNumbering{}, []int{1, 2, 3, 4, 5}},
+		{"from start", config.ChannelNumbering{Start: 100}, []int{100, 101, 102, 103, 104}},
+		{
+			"pinned only",
+			config.ChannelNumbering{Pinned: []config.PinnedChannel{{Value: "Cartoon", Number: 2}}},
+			[]int{1, 3, 2, 4, 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := NewOrderer(config.ChannelOrder{}, tt.numbering)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := o.ChannelNumbers(orderTracks()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ChannelNumbers() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var o *Orderer
+	if got, want := o.ChannelNumbers(orderTracks()), []int{1, 2, 3, 4, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("nil ChannelNumbers() = %v, want %v", got, want)
+	}
+}
+
+func TestOrdererApply(t *testing.T) {
+	o, err := NewOrderer(
+		config.ChannelOrder{Groups: []string{"News"}},
+		config.ChannelNumbering{Start: 1, Pinned: []config.PinnedChannel{{Value: "BBC One", Number: 1}}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := orderTracks()
+	res, order := o.Apply(tracks)
+
+	if want := []int{0, 4, 1, 3, 2}; !reflect.DeepEqual(order, want) {
+		t.Errorf("Apply() order = %v, want %v", order, want)
+	}
+
+	want := map[string]string{"CNN": "2", "Al Jazeera": "3", "bbc two": "4", "Cartoon": "5", "BBC One": "1"}
+	for i := range res {
+		if got := Field(&res[i], ChannelNumberTag); got != want[res[i].Name] {
+			t.Errorf("Apply() %s number = %q, want %q", res[i].Name, got, want[res[i].Name])
+		}
+	}
+
+	if !reflect.DeepEqual(tracks, orderTracks()) {
+		t.Error("Apply() modified the given tracks")
+	}
+}
+
+func TestNewOrdererErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		order     config.ChannelOrder
+		numbering config.ChannelNumbering
+	}{
+		{"unknown sort", config.ChannelOrder{Sort: "random"}, config.ChannelNumbering{}},
+		{"negative start", config.ChannelOrder{}, config.ChannelNumbering{Start: -1}},
+		{"invalid number", config.ChannelOrder{}, config.ChannelNumbering{Pinned: []config.PinnedChannel{{Value: "CNN"}}}},
+		{
+			"number pinned twice",
+			config.ChannelOrder{},
+			config.ChannelNumbering{Pinned: []config.PinnedChannel{{Value: "CNN", Number: 1}, {Value: "BBC One", Number: 1}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewOrderer(tt.order, tt.numbering); err == nil {
+				t.Error("NewOrderer(), want an error")
+			}
+		})
+	}
+}
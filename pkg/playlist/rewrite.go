@@ -0,0 +1,163 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// Rewrite actions.
+const (
+	// RewriteReplace replace the matches of a regex in the target field.
+	RewriteReplace = "replace"
+	// RewriteSet set the target tag if it's missing or empty.
+	RewriteSet = "set"
+	// RewriteOverride set the target tag, replacing its current value.
+	RewriteOverride = "override"
+	// RewriteRemove remove the target tag.
+	RewriteRemove = "remove"
+)
+
+type rewrite struct {
+	// condition, nil to rewrite all the tracks
+	when        *matcher
+	action      string
+	target      string
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// Rewriter is a compiled list of rewrite rules, applied in order.
+type Rewriter struct {
+	rules []rewrite
+}
+
+// NewRewriter compile rewrite rules.
+func NewRewriter(rules []config.RewriteRule) (*Rewriter, error) {
+	r := &Rewriter{rules: make([]rewrite, 0, len(rules))}
+
+	for i, rule := range rules {
+		rw := rewrite{
+			action:      rule.Action,
+			target:      rule.Target,
+			replacement: rule.Replacement,
+		}
+
+		if rule.Field != "" {
+			m, err := newMatcher(rule.Field, rule.Match, rule.Value)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite %d: %w", i, err)
+			}
+			rw.when = m
+		}
+
+		if rule.Target == "" {
+			return nil, fmt.Errorf("rewrite %d: missing target", i)
+		}
+
+		switch rule.Action {
+		case RewriteReplace:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("rewrite %d: pattern %q: %w", i, rule.Pattern, err)
+			}
+			rw.pattern = re
+		case RewriteSet, RewriteOverride, RewriteRemove:
+			if rule.Target == NameField && rule.Action == RewriteRemove {
+				return nil, fmt.Errorf("rewrite %d: the track name can't be removed", i)
+			}
+		default:
+			return nil, fmt.Errorf("rewrite %d: unknown action %q", i, rule.Action)
+		}
+
+		r.rules = append(r.rules, rw)
+	}
+
+	return r, nil
+}
+
+// Apply return the rewritten tracks, the given tracks are left untouched.
+func (r *Rewriter) Apply(tracks []m3u.Track) []m3u.Track {
+	if r == nil || len(r.rules) == 0 {
+		return tracks
+	}
+
+	res := make([]m3u.Track, len(tracks))
+	for i := range tracks {
+		res[i] = tracks[i]
+		res[i].Tags = append([]m3u.Tag(nil), tracks[i].Tags...)
+
+		for _, rw := range r.rules {
+			if rw.when != nil && !rw.when.matches(&res[i]) {
+				continue
+			}
+			rw.apply(&res[i])
+		}
+	}
+
+	return res
+}
+
+func (rw *rewrite) apply(track *m3u.Track) {
+	switch rw.action {
+	case RewriteReplace:
+		value := rw.pattern.ReplaceAllString(Field(track, rw.target), rw.replacement)
+		SetField(track, rw.target, strings.TrimSpace(value))
+	case RewriteSet:
+		if Field(track, rw.target) == "" {
+			SetField(track, rw.target, rw.replacement)
+		}
+	case RewriteOverride:
+		SetField(track, rw.target, rw.replacement)
+	case RewriteRemove:
+		removeTag(track, rw.target)
+	}
+}
+
+// SetField set the track name or a tag value, adding the tag if missing.
+func SetField(track *m3u.Track, field, value string) {
+	if field == NameField {
+		track.Name = value
+		return
+	}
+
+	for i := range track.Tags {
+		if strings.EqualFold(track.Tags[i].Name, field) {
+			track.Tags[i].Value = value
+			return
+		}
+	}
+
+	track.Tags = append(track.Tags, m3u.Tag{Name: field, Value: value})
+}
+
+func removeTag(track *m3u.Track, name string) {
+	tags := track.Tags[:0]
+	for _, tag := range track.Tags {
+		if !strings.EqualFold(tag.Name, name) {
+			tags = append(tags, tag)
+		}
+	}
+	track.Tags = tags
+}
@@ -0,0 +1,164 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package playlist
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// newTrack return a track with the tags given as name, value pairs.
+func newTrack(name string, tags ...string) m3u.Track {
+	track := m3u.Track{Name: name}
+	for i := 0; i+1 < len(tags); i += 2 {
+		track.Tags = append(track.Tags, m3u.Tag{Name: tags[i], Value: tags[i+1]})
+	}
+
+	return track
+}
+
+func TestRewriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []config.RewriteRule
+		track m3u.Track
+		want  m3u.Track
+	}{
+		{
+			name:  "replace in the name",
+			rules: []config.RewriteRule{{Action: RewriteReplace, Target: NameField, Pattern: `^\|UK\|\s*`}},
+			track: newTrack("|UK| BBC One"),
+			want:  newTrack("BBC One"),
+		},
+		{
+			name:  "replace trims the result",
+			rules: []config.RewriteRule{{Action: RewriteReplace, Target: NameField, Pattern: `HD$`}},
+			track: newTrack("BBC One HD"),
+			want:  newTrack("BBC One"),
+		},
+		{
+			name:  "replace with groups",
+			rules: []config.RewriteRule{{Action: RewriteReplace, Target: "group-title", Pattern: `^(\w+) \| (\w+)$`, Replacement: "$2 ($1)"}},
+			track: newTrack("BBC One", "group-title", "UK | News"),
+			want:  newTrack("BBC One", "group-title", "News (UK)"),
+		},
+		{
+			name:  "set a missing tag",
+			rules: []config.RewriteRule{{Action: RewriteSet, Target: "tvg-logo", Replacement: "logo.png"}},
+			track: newTrack("BBC One", "tvg-id", "bbc1"),
+			want:  newTrack("BBC One", "tvg-id", "bbc1", "tvg-logo", "logo.png"),
+		},
+		{
+			name:  "set an empty tag",
+			rules: []config.RewriteRule{{Action: RewriteSet, Target: "tvg-logo", Replacement: "logo.png"}},
+			track: newTrack("BBC One", "tvg-logo", ""),
+			want:  newTrack("BBC One", "tvg-logo", "logo.png"),
+		},
+		{
+			name:  "set keeps a tag",
+			rules: []config.RewriteRule{{Action: RewriteSet, Target: "tvg-logo", Replacement: "logo.png"}},
+			track: newTrack("BBC One", "tvg-logo", "bbc.png"),
+			want:  newTrack("BBC One", "tvg-logo", "bbc.png"),
+		},
+		{
+			name:  "override a tag, case insensitive",
+			rules: []config.RewriteRule{{Action: RewriteOverride, Target: "tvg-logo", Replacement: "logo.png"}},
+			track: newTrack("BBC One", "TVG-LOGO", "bbc.png"),
+			want:  newTrack("BBC One", "TVG-LOGO", "logo.png"),
+		},
+		{
+			name:  "remove a tag",
+			rules: []config.RewriteRule{{Action: RewriteRemove, Target: "tvg-logo"}},
+			track: newTrack("BBC One", "tvg-id", "bbc1", "tvg-logo", "bbc.png"),
+			want:  newTrack("BBC One", "tvg-id", "bbc1"),
+		},
+		{
+			name: "condition matched",
+			rules: []config.RewriteRule{{
+				Field: "group-title", Match: MatchGlob, Value: "UK*",
+				Action: RewriteOverride, Target: "group-title", Replacement: "UK",
+			}},
+			track: newTrack("BBC One", "group-title", "UK News"),
+			want:  newTrack("BBC One", "group-title", "UK"),
+		},
+		{
+			name: "condition not matched",
+			rules: []config.RewriteRule{{
+				Field: "group-title", Match: MatchGlob, Value: "UK*",
+				Action: RewriteOverride, Target: "group-title", Replacement: "UK",
+			}},
+			track: newTrack("CNN", "group-title", "US News"),
+			want:  newTrack("CNN", "group-title", "US News"),
+		},
+		{
+			name: "rules applied in order",
+			rules: []config.RewriteRule{
+				{Action: RewriteReplace, Target: NameField, Pattern: ` FHD$`},
+				{Field: NameField, Value: "BBC One", Action: RewriteSet, Target: "tvg-id", Replacement: "bbc1"},
+			},
+			track: newTrack("BBC One FHD"),
+			want:  newTrack("BBC One", "tvg-id", "bbc1"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRewriter(tt.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			original := tt.track
+			original.Tags = append([]m3u.Tag(nil), tt.track.Tags...)
+
+			got := r.Apply([]m3u.Track{tt.track})
+			if !reflect.DeepEqual(got[0], tt.want) {
+				t.Errorf("Apply() = %+v, want %+v", got[0], tt.want)
+			}
+			if !reflect.DeepEqual(tt.track, original) {
+				t.Errorf("Apply() modified the given track, %+v", tt.track)
+			}
+		})
+	}
+}
+
+func TestNewRewriterErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule config.RewriteRule
+	}{
+		{"missing target", config.RewriteRule{Action: RewriteOverride}},
+		{"unknown action", config.RewriteRule{Action: "rename", Target: NameField}},
+		{"invalid pattern", config.RewriteRule{Action: RewriteReplace, Target: NameField, Pattern: "("}},
+		{"name removed", config.RewriteRule{Action: RewriteRemove, Target: NameField}},
+		{"invalid condition", config.RewriteRule{Field: NameField, Match: MatchRegex, Value: "(", Action: RewriteRemove, Target: "tvg-logo"}},
+		{"unknown match", config.RewriteRule{Field: NameField, Match: "fuzzy", Action: RewriteRemove, Target: "tvg-logo"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewRewriter([]config.RewriteRule{tt.rule}); err == nil {
+				t.Error("NewRewriter(), want an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+)
+
+const (
+	defaultLockout = time.Minute
+	maxLockout     = 24 * time.Hour
+	// failuresRetention is how long the failures of a client are remembered
+	failuresRetention = 24 * time.Hour
+	// the forgotten clients are removed every sweepInterval,
+	// or earlier when the clients doubled since the last sweep
+	sweepInterval = time.Hour
+	minSweepSize  = 1024
+)
+
+// accessGuard enforce the CIDR lists and lock out the clients failing to authenticate.
+type accessGuard struct {
+	allow, deny []*net.IPNet
+	maxFailures int
+	lockout     time.Duration
+
+	sync.Mutex
+	clients   map[string]*clientFailures
+	nextSweep time.Time
+	sweepSize int
+}
+
+// clientFailures is the authentication failures of a client address.
+type clientFailures struct {
+	failures    int
+	lockouts    int
+	lockedUntil time.Time
+	last        time.Time
+}
+
+func newAccessGuard(access config.AccessControl) (*accessGuard, error) {
+	allow, err := parseCIDRs(access.Allow)
+	if err != nil {
+		return nil, fmt.Errorf("access allow: %w", err)
+	}
+
+	deny, err := parseCIDRs(access.Deny)
+	if err != nil {
+		return nil, fmt.Errorf("access deny: %w", err)
+	}
+
+	lockout := time.Duration(access.Lockout) * time.Second
+	if lockout <= 0 {
+		lockout = defaultLockout
+	}
+
+	return &accessGuard{
+		allow:       allow,
+		deny:        deny,
+		maxFailures: access.MaxFailures,
+		lockout:     lockout,
+		clients:     map[string]*clientFailures{},
+		nextSweep:   time.Now().Add(sweepInterval),
+		sweepSize:   minSweepSize,
+	}, nil
+}
+
+// parseCIDRs parse CIDR, a single address being accepted as well.
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	res := make([]*net.IPNet, 0, len(list))
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, n)
+	}
+
+	return res, nil
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowed tell if the CIDR lists let the client in.
+func (g *accessGuard) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(g.allow) == 0
+	}
+	if contains(g.deny, ip) {
+		return false
+	}
+
+	return len(g.allow) == 0 || contains(g.allow, ip)
+}
+
+// locked return how long the client is still locked out.
+func (g *accessGuard) locked(client string) time.Duration {
+	g.Lock()
+	defer g.Unlock()
+
+	c, ok := g.clients[client]
+	if !ok {
+		return 0
+	}
+
+	return time.Until(c.lockedUntil)
+}
+
+// failure count an authentication failure of the client, locking it out after
+// max failures for a duration doubling at each lockout.
+func (g *accessGuard) failure(client string) {
+	if g.maxFailures <= 0 {
+		return
+	}
+
+	g.Lock()
+	defer g.Unlock()
+
+	now := time.Now()
+	if now.After(g.nextSweep) || len(g.clients) >= g.sweepSize {
+		g.forget(now)
+	}
+
+	c, ok := g.clients[client]
+	if !ok {
+		c = &clientFailures{}
+		g.clients[client] = c
+	}
+	c.last = now
+	c.failures++
+
+	if c.failures < g.maxFailures {
+		return
+	}
+
+	lockout := time.Duration(float64(g.lockout) * math.Pow(2, float64(c.lockouts)))
+	if lockout > maxLockout {
+		lockout = maxLockout
+	}
+	c.failures = 0
+	c.lockouts++
+	c.lockedUntil = now.Add(lockout)
+	logger.Warn("client locked out", "client", client, "lockout", lockout, "failures", g.maxFailures)
+}
+
+// success forget the failures of the client.
+func (g *accessGuard) success(client string) {
+	g.Lock()
+	defer g.Unlock()
+
+	delete(g.clients, client)
+}
+
+// forget the clients without failure for a while, it must be called with the lock held.
+func (g *accessGuard) forget(now time.Time) {
+	for client, c := range g.clients {
+		if now.Sub(c.last) > failuresRetention && now.After(c.lockedUntil) {
+			delete(g.clients, client)
+		}
+	}
+
+	g.nextSweep = now.Add(sweepInterval)
+	g.sweepSize = 2 * len(g.clients)
+	if g.sweepSize < minSweepSize {
+		g.sweepSize = minSweepSize
+	}
+}
+
+// accessControl refuse the clients out of the CIDR lists or locked out.
+func (c *Config) accessControl(ctx *gin.Context) {
+	client := ctx.ClientIP()
+
+	if !c.access.allowed(net.ParseIP(client)) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	if d := c.access.locked(client); d > 0 {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(d.Seconds()))))
+		ctx.AbortWithStatus(http.StatusTooManyRequests)
+		return
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestAccessGuardLockout(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxFailures int
+		lockout     int
+		failures    int
+		success     bool
+		want        time.Duration
+	}{
+		{"disabled", 0, 60, 10, false, 0},
+		{"under the max", 3, 60, 2, false, 0},
+		{"first lockout", 3, 60, 3, false, time.Minute},
+		{"default lockout", 3, 0, 3, false, defaultLockout},
+		{"second lockout doubled", 3, 60, 6, false, 2 * time.Minute},
+		{"third lockout doubled", 3, 60, 9, false, 4 * time.Minute},
+		{"failures after a lockout", 3, 60, 5, false, time.Minute},
+		{"capped", 1, 3600, 10, false, maxLockout},
+		{"reset by a success", 3, 60, 3, true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := newAccessGuard(config.AccessControl{MaxFailures: tt.maxFailures, Lockout: tt.lockout})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.failures; i++ {
+				g.failure("192.0.2.1")
+			}
+			if tt.success {
+				g.success("192.0.2.1")
+			}
+
+			got := g.locked("192.0.2.1")
+			if got < 0 {
+				got = 0
+			}
+			if got > tt.want || got < tt.want-time.Second {
+				t.Errorf("locked() = %v, want %v", got, tt.want)
+			}
+			if d := g.locked("192.0.2.2"); d > 0 {
+				t.Errorf("locked() of another client = %v, want 0", d)
+			}
+		})
+	}
+}
+
+func TestAccessGuardForget(t *testing.T) {
+	g, err := newAccessGuard(config.AccessControl{MaxFailures: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	old := now.Add(-failuresRetention - time.Minute)
+	g.clients["old"] = &clientFailures{failures: 1, last: old}
+	g.clients["old locked"] = &clientFailures{last: old, lockedUntil: now.Add(time.Hour)}
+	g.clients["recent"] = &clientFailures{failures: 1, last: now}
+
+	// not swept before the interval
+	g.failure("new")
+	if _, ok := g.clients["old"]; !ok {
+		t.Fatal("client forgotten before the sweep interval")
+	}
+
+	g.nextSweep = now
+	g.failure("new")
+	for client, want := range map[string]bool{"old": false, "old locked": true, "recent": true, "new": true} {
+		if _, ok := g.clients[client]; ok != want {
+			t.Errorf("client %q kept = %v, want %v", client, ok, want)
+		}
+	}
+	if g.sweepSize != minSweepSize {
+		t.Errorf("sweepSize = %d, want %d", g.sweepSize, minSweepSize)
+	}
+}
+
+func TestAccessGuardAllowed(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		want        bool
+	}{
+		{"no lists", nil, nil, "192.0.2.1", true},
+		{"allowed", []string{"192.0.2.0/24"}, nil, "192.0.2.1", true},
+		{"not allowed", []string{"192.0.2.0/24"}, nil, "198.51.100.1", false},
+		{"single address", []string{"192.0.2.1"}, nil, "192.0.2.1", true},
+		{"single address other", []string{"192.0.2.1"}, nil, "192.0.2.2", false},
+		{"denied", nil, []string{"192.0.2.0/24"}, "192.0.2.1", false},
+		{"deny wins", []string{"192.0.2.0/24"}, []string{"192.0.2.1"}, "192.0.2.1", false},
+		{"ipv6", []string{"2001:db8::/32"}, nil, "2001:db8::1", true},
+		{"ipv6 single address", nil, []string{"2001:db8::1"}, "2001:db8::1", false},
+		{"unknown address", nil, nil, "", true},
+		{"unknown address with allow list", []string{"192.0.2.0/24"}, nil, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := newAccessGuard(config.AccessControl{Allow: tt.allow, Deny: tt.deny})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := g.allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("allowed(%q) = %v, want %v", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAccessGuardInvalidCIDR(t *testing.T) {
+	if _, err := newAccessGuard(config.AccessControl{Allow: []string{"192.0.2.0/33"}}); err == nil {
+		t.Error("newAccessGuard() with an invalid CIDR, want an error")
+	}
+}
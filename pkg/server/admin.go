@@ -0,0 +1,585 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/cors"
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/playlist"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
+)
+
+type adminSource struct {
+	ID              int       `json:"id"`
+	Name            string    `json:"name"`
+	URL             string    `json:"url"`
+	Tracks          int       `json:"tracks"`
+	RefreshInterval int       `json:"refresh_interval"`
+	LastRefresh     time.Time `json:"last_refresh"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type adminProvider struct {
+	Name           string `json:"name"`
+	BaseURL        string `json:"base_url"`
+	User           string `json:"user"`
+	MaxConnections int    `json:"max_connections"`
+}
+
+type adminTrack struct {
+	ID       string            `json:"id"`
+	Name     string            `json:"name"`
+	Group    string            `json:"group"`
+	Logo     string            `json:"logo"`
+	URI      string            `json:"uri"`
+	Tags     map[string]string `json:"tags"`
+	Disabled bool              `json:"disabled"`
+	Override *channelOverride  `json:"override,omitempty"`
+}
+
+type adminSession struct {
+	ID       uint64    `json:"id"`
+	Account  string    `json:"account"`
+	User     string    `json:"user"`
+	Channel  string    `json:"channel"`
+	Client   string    `json:"client"`
+	URL      string    `json:"url"`
+	Priority int       `json:"priority"`
+	Started  time.Time `json:"started"`
+	Bytes    int64     `json:"bytes"`
+	// Bitrate is the average since the start in bits per second
+	Bitrate int64 `json:"bitrate"`
+}
+
+// adminUser is an account in the admin API, the quotas being in MB.
+type adminUser struct {
+	Username      string                  `json:"username"`
+	Password      config.CredentialString `json:"password,omitempty"`
+	Disabled      bool                    `json:"disabled"`
+	Expiry        string                  `json:"expiry"`
+	AllowedGroups []string                `json:"allowed_groups"`
+	MaxStreams    int                     `json:"max_streams"`
+	DailyQuota    int64                   `json:"daily_quota"`
+	MonthlyQuota  int64                   `json:"monthly_quota"`
+	Priority      int                     `json:"priority"`
+	Admin         bool                    `json:"admin"`
+	Usage         *adminUsage             `json:"usage,omitempty"`
+}
+
+// adminUsage is the usage of an account, the watch times being in seconds.
+type adminUsage struct {
+	ActiveStreams  int    `json:"active_streams"`
+	Day            string `json:"day"`
+	Month          string `json:"month"`
+	DayBytes       int64  `json:"day_bytes"`
+	MonthBytes     int64  `json:"month_bytes"`
+	TotalBytes     int64  `json:"total_bytes"`
+	DayWatchTime   int64  `json:"day_watch_time"`
+	MonthWatchTime int64  `json:"month_watch_time"`
+	TotalWatchTime int64  `json:"total_watch_time"`
+}
+
+func (u *adminUser) account() config.UserAccount {
+	return config.UserAccount{
+		Username:      u.Username,
+		Password:      u.Password,
+		Disabled:      u.Disabled,
+		Expiry:        u.Expiry,
+		AllowedGroups: u.AllowedGroups,
+		MaxStreams:    u.MaxStreams,
+		DailyQuota:    u.DailyQuota,
+		MonthlyQuota:  u.MonthlyQuota,
+		Priority:      u.Priority,
+		Admin:         u.Admin,
+	}
+}
+
+func (c *Config) adminRoutes(r *gin.RouterGroup) {
+	api := r.Group("/admin/api", c.adminSameOrigin, c.adminAuthenticate)
+
+	api.GET("/sources", c.adminSources)
+	api.POST("/sources/:id/refresh", c.adminRefreshSource)
+	api.POST("/refresh", c.adminRefresh)
+	api.GET("/playlist", c.adminPlaylist)
+	api.PUT("/channels/:id", c.adminSetChannel)
+	api.DELETE("/channels/:id", c.adminResetChannel)
+	api.GET("/streams", c.adminStreams)
+	api.DELETE("/streams/:id", c.adminKillStream)
+	api.GET("/users", c.adminUsers)
+	api.GET("/users/:name", c.adminUser)
+	api.GET("/users/:name/urls", c.adminUserURLs)
+	api.POST("/users", c.adminAddUser)
+	api.PUT("/users/:name", c.adminUpdateUser)
+	api.DELETE("/users/:name", c.adminRemoveUser)
+	api.DELETE("/cache", c.adminFlushCache)
+
+	c.dashboardRoutes(r)
+}
+
+// adminSameOrigin refuse the cross-site requests a browser would send with the cached
+// basic auth credentials: the origin must be the proxy hostname and the changes must be JSON,
+// which a form can't send.
+func (c *Config) adminSameOrigin(ctx *gin.Context) {
+	if origin := ctx.GetHeader("Origin"); origin != "" {
+		hostname := c.HostConfig.Hostname
+		if hostname == "" {
+			hostname = (&url.URL{Host: ctx.Request.Host}).Hostname()
+		}
+		u, err := url.Parse(origin)
+		if err != nil || !strings.EqualFold(u.Hostname(), hostname) {
+			ctx.AbortWithError(http.StatusForbidden, fmt.Errorf("origin %q isn't allowed", origin)) // nolint: errcheck
+			return
+		}
+	}
+
+	switch ctx.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		if ctx.ContentType() != gin.MIMEJSON {
+			ctx.AbortWithError(http.StatusUnsupportedMediaType, errors.New("expected an application/json request")) // nolint: errcheck
+		}
+	}
+}
+
+// adminPath tell if the request is for the admin API or the dashboard.
+func (c *Config) adminPath(p string) bool {
+	return strings.HasPrefix(p, path.Join("/", c.CustomEndpoint, "admin")+"/")
+}
+
+// cors allow the players of every origin, except on the admin endpoints.
+func (c *Config) cors() gin.HandlerFunc {
+	allowAll := cors.Default()
+
+	return func(ctx *gin.Context) {
+		if c.adminPath(ctx.Request.URL.Path) {
+			return
+		}
+		allowAll(ctx)
+	}
+}
+
+// adminAuthenticate authenticate an admin user with the basic auth credentials.
+func (c *Config) adminAuthenticate(ctx *gin.Context) {
+	ctx.Header("WWW-Authenticate", `Basic realm="iptv-proxy"`)
+
+	username, password, ok := ctx.Request.BasicAuth()
+	if !ok {
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	// the stream tokens given to the players are never accepted here
+	user, err := c.users.Authenticate(username, password)
+	if !c.loggedIn(ctx, user, err) {
+		return
+	}
+	ctx.Writer.Header().Del("WWW-Authenticate")
+
+	if !requestUser(ctx).Admin {
+		ctx.AbortWithStatus(http.StatusForbidden)
+	}
+}
+
+func (c *Config) adminSources(ctx *gin.Context) {
+	sources := make([]adminSource, 0, len(c.sources))
+	for i := range c.sources {
+		sources = append(sources, c.adminSource(i))
+	}
+
+	providers := make([]adminProvider, 0, len(c.xtreamProviders))
+	for _, p := range c.xtreamProviders {
+		providers = append(providers, adminProvider{
+			Name:           p.Name,
+			BaseURL:        p.BaseURL,
+			User:           p.User.String(),
+			MaxConnections: p.maxConnections(),
+		})
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"sources": sources, "xtream_providers": providers})
+}
+
+func (c *Config) adminSource(i int) adminSource {
+	s := c.sources[i]
+
+	s.RLock()
+	defer s.RUnlock()
+
+	res := adminSource{
+		ID:              i,
+		Name:            s.Name,
+		URL:             redactURL(s.URL),
+		Tracks:          len(s.tracks),
+		RefreshInterval: s.RefreshInterval,
+		LastRefresh:     s.lastRefresh,
+	}
+	if s.lastErr != nil {
+		res.Error = logger.Redact(s.lastErr.Error())
+	}
+
+	return res
+}
+
+// redactURL hide the password of an url, in its user info or its query.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+
+	q := u.Query()
+	if q.Get("password") != "" {
+		q.Set("password", "xxxxx")
+		u.RawQuery = q.Encode()
+	}
+
+	return u.Redacted()
+}
+
+func (c *Config) adminRefreshSource(ctx *gin.Context) {
+	i, err := strconv.Atoi(ctx.Param("id"))
+	if err != nil || i < 0 || i >= len(c.sources) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := c.refreshSources(c.sources[i]); err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c.adminSource(i))
+}
+
+// adminRefresh refresh all the sources and flush the Xtream playlists cache.
+func (c *Config) adminRefresh(ctx *gin.Context) {
+	if err := c.refreshSources(c.sources...); err != nil {
+		ctx.AbortWithError(http.StatusBadGateway, err) // nolint: errcheck
+		return
+	}
+	flushXtreamM3uCache()
+
+	c.adminSources(ctx)
+}
+
+// refreshSources fetch the sources and rebuild the playlist, the sources failing keep their tracks.
+func (c *Config) refreshSources(sources ...*m3uSource) error {
+	var errs []error
+	for _, source := range sources {
+		if err := source.refresh(); err != nil {
+			logger.Error("source refresh", "source", source.Name, "error", err)
+			errs = append(errs, fmt.Errorf("source %q: %w", source.Name, err))
+		}
+	}
+
+	if err := c.rebuildPlaylist(); err != nil {
+		return err
+	}
+	logger.Info("sources refreshed", "tracks", c.tracks.len())
+
+	if len(errs) > 0 {
+		return errs[0]
+	}
+
+	return nil
+}
+
+func (c *Config) adminPlaylist(ctx *gin.Context) {
+	group := ctx.Query("group")
+
+	tracks, ids := c.tracks.snapshot()
+	res := make([]adminTrack, 0, len(tracks))
+	for i := range tracks {
+		g := playlist.Field(&tracks[i], "group-title")
+		if group != "" && g != group {
+			continue
+		}
+
+		tags := make(map[string]string, len(tracks[i].Tags))
+		for _, tag := range tracks[i].Tags {
+			tags[tag.Name] = tag.Value
+		}
+
+		t := adminTrack{
+			ID:    ids[i],
+			Name:  tracks[i].Name,
+			Group: g,
+			Logo:  playlist.Field(&tracks[i], "tvg-logo"),
+			URI:   redactURL(tracks[i].URI),
+			Tags:  tags,
+		}
+		if o, ok := c.overrides.get(ids[i]); ok {
+			t.Disabled = o.Disabled
+			t.Override = &o
+		}
+		res = append(res, t)
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+// adminSetChannel replace the override of a channel and rebuild the playlist.
+func (c *Config) adminSetChannel(ctx *gin.Context) {
+	var o channelOverride
+	if err := ctx.ShouldBindJSON(&o); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	c.updateChannel(ctx, o)
+}
+
+func (c *Config) adminResetChannel(ctx *gin.Context) {
+	c.updateChannel(ctx, channelOverride{})
+}
+
+func (c *Config) updateChannel(ctx *gin.Context, o channelOverride) {
+	id := ctx.Param("id")
+	if _, ok := c.tracks.lookup(id); !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if err := c.overrides.set(id, o); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	if err := c.rebuildPlaylist(); err != nil {
+		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *Config) adminStreams(ctx *gin.Context) {
+	sessions := c.sessions.list()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+
+	res := make([]adminSession, 0, len(sessions))
+	for _, s := range sessions {
+		bytes := atomic.LoadInt64(s.bytes)
+
+		var bitrate int64
+		if elapsed := time.Since(s.started).Seconds(); elapsed > 0 {
+			bitrate = int64(float64(bytes*8) / elapsed)
+		}
+
+		res = append(res, adminSession{
+			ID:       s.id,
+			Account:  s.account,
+			User:     s.user,
+			Channel:  s.channel,
+			Client:   s.client,
+			URL:      redactURL(s.url),
+			Priority: s.priority,
+			Started:  s.started,
+			Bytes:    bytes,
+			Bitrate:  bitrate,
+		})
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (c *Config) adminKillStream(ctx *gin.Context) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 64)
+	if err != nil || !c.sessions.kill(id) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+func (c *Config) adminUsers(ctx *gin.Context) {
+	list := c.users.List()
+	res := make([]adminUser, 0, len(list))
+	for i := range list {
+		res = append(res, c.adminUserView(&list[i]))
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (c *Config) adminUser(ctx *gin.Context) {
+	u, ok := c.users.Get(ctx.Param("name"))
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, c.adminUserView(&u))
+}
+
+// adminUserURLs return the playlists urls of a user. The password is only known
+// when it is stored in plain text or replaced by a token, "PASSWORD" is used otherwise.
+func (c *Config) adminUserURLs(ctx *gin.Context) {
+	u, ok := c.users.Get(ctx.Param("name"))
+	if !ok {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	password := u.Password.String()
+	switch {
+	case c.tokens != nil:
+		password = c.tokens.Sign(u.Name, users.AnyChannel)
+	case users.IsHash(password):
+		password = "PASSWORD"
+	}
+
+	protocol := "http"
+	if c.HTTPS {
+		protocol = "https"
+	}
+	base := fmt.Sprintf("%s://%s:%d%s", protocol, c.HostConfig.Hostname, c.AdvertisedPort, strings.TrimRight("/"+strings.Trim(c.CustomEndpoint, "/"), "/"))
+
+	q := url.Values{"username": {u.Name}, "password": {password}}
+	res := gin.H{"m3u": fmt.Sprintf("%s/%s?%s", base, c.M3UFileName, q.Encode())}
+	if len(c.xtreamProviders) > 0 {
+		q.Set("type", "m3u_plus")
+		res["xtream"] = gin.H{
+			"server":   base,
+			"username": u.Name,
+			"password": password,
+			"get":      fmt.Sprintf("%s/get.php?%s", base, q.Encode()),
+		}
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
+func (c *Config) adminUserView(u *users.User) adminUser {
+	usage := c.users.Usage(u.Name)
+
+	res := adminUser{
+		Username:      u.Name,
+		Disabled:      u.Disabled,
+		AllowedGroups: u.AllowedGroups,
+		MaxStreams:    u.MaxStreams,
+		DailyQuota:    u.DailyQuota >> 20,
+		MonthlyQuota:  u.MonthlyQuota >> 20,
+		Priority:      u.Priority,
+		Admin:         u.Admin,
+		Usage: &adminUsage{
+			ActiveStreams:  usage.ActiveStreams,
+			Day:            usage.Day,
+			Month:          usage.Month,
+			DayBytes:       usage.DayBytes,
+			MonthBytes:     usage.MonthBytes,
+			TotalBytes:     usage.TotalBytes,
+			DayWatchTime:   int64(usage.DayWatchTime.Seconds()),
+			MonthWatchTime: int64(usage.MonthWatchTime.Seconds()),
+			TotalWatchTime: int64(usage.TotalWatchTime.Seconds()),
+		},
+	}
+	if !u.Expiry.IsZero() {
+		res.Expiry = u.Expiry.Format(time.RFC3339)
+	}
+
+	return res
+}
+
+func (c *Config) adminAddUser(ctx *gin.Context) {
+	var u adminUser
+	if err := ctx.ShouldBindJSON(&u); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+
+	if err := c.users.Add(u.account()); err != nil {
+		abortUsers(ctx, err)
+		return
+	}
+	addPasswordSecret(u.Password.String())
+
+	c.adminUserResponse(ctx, u.Username, http.StatusCreated)
+}
+
+func (c *Config) adminUpdateUser(ctx *gin.Context) {
+	var u adminUser
+	if err := ctx.ShouldBindJSON(&u); err != nil {
+		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+		return
+	}
+	u.Username = ctx.Param("name")
+
+	if err := c.users.Update(u.account()); err != nil {
+		abortUsers(ctx, err)
+		return
+	}
+	addPasswordSecret(u.Password.String())
+
+	c.adminUserResponse(ctx, u.Username, http.StatusOK)
+}
+
+func (c *Config) adminUserResponse(ctx *gin.Context, name string, code int) {
+	u, _ := c.users.Get(name)
+	ctx.JSON(code, c.adminUserView(&u))
+}
+
+func (c *Config) adminRemoveUser(ctx *gin.Context) {
+	if err := c.users.Remove(ctx.Param("name")); err != nil {
+		abortUsers(ctx, err)
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// abortUsers answer a failed change of the accounts.
+func abortUsers(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, users.ErrUnknownUser):
+		ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+	case errors.Is(err, users.ErrUserExists):
+		ctx.AbortWithError(http.StatusConflict, err) // nolint: errcheck
+	default:
+		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
+	}
+}
+
+func (c *Config) adminFlushCache(ctx *gin.Context) {
+	flushXtreamM3uCache()
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// flushXtreamM3uCache drop the generated Xtream playlists, they are generated again on the next request.
+func flushXtreamM3uCache() {
+	xtreamM3uCacheLock.Lock()
+	defer xtreamM3uCacheLock.Unlock()
+
+	xtreamM3uCache = map[string]cacheMeta{}
+}
@@ -19,41 +19,79 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/playlist"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func (c *Config) getM3U(ctx *gin.Context) {
+	tracks, ids := c.tracks.snapshot()
+
 	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
 	ctx.Header("Content-Type", "application/octet-stream")
 
-	ctx.File(c.proxyfiedM3UPath)
+	c.marshallInto(ctx.Writer, tracks, ids, requestUser(ctx), false)
+}
+
+// trackProxy resolve the requested track from the track index and proxy it.
+func (c *Config) trackProxy(ctx *gin.Context) {
+	track, ok := c.tracks.lookup(ctx.Param("track"))
+	if !ok || c.overrides.disabled(ctx.Param("track")) {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	if !requestUser(ctx).Allowed(playlist.Field(&track.Track, "group-title")) {
+		ctx.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	if strings.HasSuffix(track.URI, ".m3u8") {
+		c.m3u8ReverseProxy(ctx, &track.Track)
+		return
+	}
+
+	c.reverseProxy(ctx, &track)
 }
 
-func (c *Config) reverseProxy(ctx *gin.Context) {
-	rpURL, err := url.Parse(c.track.URI)
+func (c *Config) reverseProxy(ctx *gin.Context, track *indexedTrack) {
+	rpURL, err := url.Parse(track.URI)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
 
-	c.stream(ctx, rpURL)
+	fallbacks := make([]*url.URL, 0, len(track.alternates))
+	for _, uri := range track.alternates {
+		u, err := url.Parse(uri)
+		if err != nil {
+			continue
+		}
+		fallbacks = append(fallbacks, u)
+	}
+
+	c.liveStream(ctx, rpURL, fallbacks...)
 }
 
-func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
+func (c *Config) m3u8ReverseProxy(ctx *gin.Context, track *m3u.Track) {
 	id := ctx.Param("id")
 
-	rpURL, err := url.Parse(strings.ReplaceAll(c.track.URI, path.Base(c.track.URI), id))
+	rpURL, err := url.Parse(strings.ReplaceAll(track.URI, path.Base(track.URI), id))
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -62,32 +100,116 @@ func (c *Config) m3u8ReverseProxy(ctx *gin.Context) {
 	c.stream(ctx, rpURL)
 }
 
-func (c *Config) stream(ctx *gin.Context, oriURL *url.URL) {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", oriURL.String(), nil)
+// stream proxy oriURL, the fallbacks are tried in order when the upstream
+// can't be reached, answers with a non 2xx status or sends no data before the failover timeout.
+func (c *Config) stream(ctx *gin.Context, oriURL *url.URL, fallbacks ...*url.URL) {
+	resp, body, err := c.openUpstream(ctx, append([]*url.URL{oriURL}, fallbacks...))
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		abortStream(ctx, err)
 		return
 	}
+	defer resp.Body.Close()
 
-	mergeHttpHeader(req.Header, ctx.Request.Header)
+	copyResponse(ctx, resp, body)
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+// liveStream proxy a live channel, sharing its upstream connection
+// between the viewers when the stream multiplexer is enabled.
+func (c *Config) liveStream(ctx *gin.Context, oriURL *url.URL, fallbacks ...*url.URL) {
+	if c.mux == nil || ctx.GetHeader("Range") != "" {
+		c.stream(ctx, oriURL, fallbacks...)
 		return
 	}
-	defer resp.Body.Close()
 
+	c.muxStream(ctx, append([]*url.URL{oriURL}, fallbacks...))
+}
+
+// openUpstream open the first candidate answering properly, the last one is returned as is.
+func (c *Config) openUpstream(ctx *gin.Context, candidates []*url.URL) (*http.Response, io.Reader, error) {
+	for i, u := range candidates {
+		last := i == len(candidates)-1
+
+		resp, body, err := c.upstream(ctx, u, !last)
+		if err == nil || last {
+			return resp, body, err
+		}
+
+		requestLogger(ctx).Warn("stream failed, trying next url", "url", u.Redacted(), "error", err)
+	}
+
+	return nil, nil, fmt.Errorf("no stream url")
+}
+
+func copyResponse(ctx *gin.Context, resp *http.Response, body io.Reader) {
 	mergeHttpHeader(ctx.Writer.Header(), resp.Header)
 	ctx.Status(resp.StatusCode)
 	ctx.Stream(func(w io.Writer) bool {
-		io.Copy(w, resp.Body) // nolint: errcheck
+		io.Copy(w, body) // nolint: errcheck
 		return false
 	})
 }
 
+// upstream open oriURL within a session of its provider account. When check is set,
+// a non 2xx status or no data before the failover timeout is an error and the response is closed.
+// The returned reader replays the data read to check the response.
+func (c *Config) upstream(ctx *gin.Context, oriURL *url.URL, check bool) (*http.Response, io.Reader, error) {
+	client := &http.Client{}
+
+	sess, sessCtx, err := c.openSession(ctx, oriURL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req, err := http.NewRequestWithContext(sessCtx, "GET", oriURL.String(), nil)
+	if err != nil {
+		c.sessions.release(sess)
+		return nil, nil, err
+	}
+
+	mergeHttpHeader(req.Header, ctx.Request.Header)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	upstreamLatency.WithLabelValues(sess.account).Observe(time.Since(start).Seconds())
+	if err != nil {
+		upstreamResponses.WithLabelValues(sess.account, "error").Inc()
+		c.sessions.release(sess)
+		return nil, nil, err
+	}
+	upstreamResponses.WithLabelValues(sess.account, strconv.Itoa(resp.StatusCode)).Inc()
+	resp.Body = &sessionBody{resp.Body, sess.bytes, func() { c.sessions.release(sess) }}
+
+	if !check {
+		return resp, resp.Body, nil
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close() // nolint: errcheck
+		return nil, nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	if c.Failover.Timeout <= 0 {
+		return resp, resp.Body, nil
+	}
+
+	// closing the body unblocks the read when the upstream stays silent
+	timer := time.AfterFunc(time.Duration(c.Failover.Timeout)*time.Second, func() {
+		resp.Body.Close() // nolint: errcheck
+	})
+
+	body := bufio.NewReader(resp.Body)
+	_, err = body.Peek(1)
+	if !timer.Stop() {
+		return nil, nil, fmt.Errorf("no data after %ds", c.Failover.Timeout)
+	}
+	if err != nil && err != io.EOF {
+		resp.Body.Close() // nolint: errcheck
+		return nil, nil, err
+	}
+
+	return resp, body, nil
+}
+
 func (c *Config) xtreamStream(ctx *gin.Context, oriURL *url.URL) {
 	id := ctx.Param("id")
 	if strings.HasSuffix(id, ".m3u8") {
@@ -127,15 +249,17 @@ type authRequest struct {
 	Password string `form:"password" binding:"required"`
 }
 
+// userKey is the context key of the authenticated user.
+const userKey = "iptv-proxy-user"
+
 func (c *Config) authenticate(ctx *gin.Context) {
 	var authReq authRequest
 	if err := ctx.Bind(&authReq); err != nil {
 		ctx.AbortWithError(http.StatusBadRequest, err) // nolint: errcheck
 		return
 	}
-	if c.ProxyConfig.User.String() != authReq.Username || c.ProxyConfig.Password.String() != authReq.Password {
-		ctx.AbortWithStatus(http.StatusUnauthorized)
-	}
+
+	c.login(ctx, authReq.Username, authReq.Password, false, users.AnyChannel)
 }
 
 func (c *Config) appAuthenticate(ctx *gin.Context) {
@@ -154,10 +278,208 @@ func (c *Config) appAuthenticate(ctx *gin.Context) {
 		ctx.AbortWithError(http.StatusBadRequest, fmt.Errorf("bad body url query parameters")) // nolint: errcheck
 		return
 	}
-	log.Printf("[iptv-proxy] %v | %s |App Auth\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
-	if c.ProxyConfig.User.String() != q["username"][0] || c.ProxyConfig.Password.String() != q["password"][0] {
-		ctx.AbortWithStatus(http.StatusUnauthorized)
+	requestLogger(ctx).Debug("app authentication", "client", ctx.ClientIP())
+	if !c.login(ctx, q["username"][0], q["password"][0], false, users.AnyChannel) {
+		return
 	}
 
 	ctx.Request.Body = ioutil.NopCloser(bytes.NewReader(contents))
 }
+
+// streamAuthenticate authenticate the credentials in the path of the stream urls,
+// the password being a stream token of the channel in tokens mode.
+func (c *Config) streamAuthenticate(ctx *gin.Context) {
+	c.login(ctx, ctx.Param("username"), ctx.Param("password"), true, streamChannel(ctx))
+}
+
+// xtreamStreamAuthenticate is streamAuthenticate also accepting the tokens of any channel,
+// the Xtream players building the streams urls with the password of the login response.
+func (c *Config) xtreamStreamAuthenticate(ctx *gin.Context) {
+	c.login(ctx, ctx.Param("username"), ctx.Param("password"), true, streamChannel(ctx), users.AnyChannel)
+}
+
+// streamChannel return the channel of a stream request.
+func streamChannel(ctx *gin.Context) string {
+	if channel := ctx.Param("track"); channel != "" {
+		return channel
+	}
+	if channel := ctx.Param("channel"); channel != "" {
+		return channel
+	}
+
+	return strings.SplitN(ctx.Param("id"), ".", 2)[0]
+}
+
+// login check the credentials and store the user in the request context.
+// In tokens mode, the password can also be a token of the user for one of the channels,
+// and the passwords are refused in the streams urls in strict mode.
+func (c *Config) login(ctx *gin.Context, username, password string, stream bool, channels ...string) bool {
+	var (
+		user users.User
+		err  error
+	)
+	if c.tokens != nil {
+		user, err = c.users.AuthenticateToken(c.tokens, username, password, channels...)
+		if errors.Is(err, users.ErrInvalidToken) && (!stream || !c.StreamTokens.Strict) {
+			user, err = c.users.Authenticate(username, password)
+		}
+	} else {
+		user, err = c.users.Authenticate(username, password)
+	}
+
+	return c.loggedIn(ctx, user, err)
+}
+
+// loggedIn store the authenticated user in the request context,
+// or abort the request when the authentication failed.
+func (c *Config) loggedIn(ctx *gin.Context, user users.User, err error) bool {
+	switch {
+	case errors.Is(err, users.ErrInvalidCredentials), errors.Is(err, users.ErrInvalidToken):
+		c.access.failure(ctx.ClientIP())
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+		return false
+	case err != nil:
+		ctx.AbortWithError(http.StatusForbidden, err) // nolint: errcheck
+		return false
+	}
+	c.access.success(ctx.ClientIP())
+
+	ctx.Set(userKey, &user)
+
+	return true
+}
+
+// hlsSessionIdle is how long the requests of an HLS channel are counted as one stream
+// after the last one, the players fetching the playlist again every few seconds.
+const hlsSessionIdle = 30 * time.Second
+
+// countStream enforce the streams limits of the user and count what the stream sends,
+// the requests of an HLS channel are counted as one stream.
+func (c *Config) countStream(ctx *gin.Context) {
+	var (
+		stream *users.Stream
+		err    error
+	)
+	if key, ok := c.hlsSession(ctx); ok {
+		stream, err = c.users.JoinStream(requestUser(ctx).Name, key, hlsSessionIdle)
+	} else {
+		stream, err = c.users.StartStream(requestUser(ctx).Name)
+	}
+	switch {
+	case errors.Is(err, users.ErrMaxStreams):
+		abortXtream(ctx, http.StatusForbidden, "Max Streams Reached", "Maximum number of streams reached", err)
+		return
+	case errors.Is(err, users.ErrQuotaExceeded):
+		abortXtream(ctx, http.StatusForbidden, "Quota Exceeded", "Bandwidth quota exceeded", err)
+		return
+	case err != nil:
+		ctx.AbortWithError(http.StatusForbidden, err) // nolint: errcheck
+		return
+	}
+	defer stream.End()
+
+	name := requestUser(ctx).Name
+	active := activeStreams.WithLabelValues(name)
+	active.Add(1)
+	defer active.Add(-1)
+
+	w := &countingWriter{ResponseWriter: ctx.Writer, stream: stream, bytes: streamedBytes.WithLabelValues(name)}
+	if c.MetricsChannels {
+		w.channel = channelBytes.WithLabelValues(c.streamChannel(ctx))
+	}
+	ctx.Writer = w
+	ctx.Next()
+}
+
+// hlsSession return the session key of the playlist and segments requests of an HLS channel.
+func (c *Config) hlsSession(ctx *gin.Context) (string, bool) {
+	if id := ctx.Param("track"); id != "" {
+		track, ok := c.tracks.lookup(id)
+		return "track:" + id, ok && strings.HasSuffix(track.URI, ".m3u8")
+	}
+
+	// the Xtream segments of a channel are requested with its upstream id
+	if channel := ctx.Param("channel"); channel != "" {
+		redirect, err := getHlsRedirectURL(channel)
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("xtream:%d:%s", redirect.provider.index, channel), true
+	}
+
+	if id := ctx.Param("id"); strings.HasSuffix(id, ".m3u8") {
+		provider, upstreamID, err := c.xtreamStreamProvider(id)
+		if err != nil {
+			return "", false
+		}
+		return fmt.Sprintf("xtream:%d:%s", provider.index, strings.TrimSuffix(upstreamID, ".m3u8")), true
+	}
+
+	return "", false
+}
+
+// countingWriter count the bytes of a response for the user usage and the metrics,
+// the writes fail once the user exceeded its quotas, which cuts the stream.
+type countingWriter struct {
+	gin.ResponseWriter
+	stream  *users.Stream
+	bytes   prometheus.Counter
+	channel prometheus.Counter // nil without --metrics-channels
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+
+	return n, w.count(n, err)
+}
+
+func (w *countingWriter) WriteString(s string) (int, error) {
+	n, err := w.ResponseWriter.WriteString(s)
+
+	return n, w.count(n, err)
+}
+
+func (w *countingWriter) count(n int, err error) error {
+	w.bytes.Add(float64(n))
+	if w.channel != nil {
+		w.channel.Add(float64(n))
+	}
+
+	if quotaErr := w.stream.Add(n); err == nil {
+		err = quotaErr
+	}
+
+	return err
+}
+
+// streamChannel return the name of the channel of a stream request,
+// the stream identifier for the Xtream streams.
+func (c *Config) streamChannel(ctx *gin.Context) string {
+	if id := ctx.Param("track"); id != "" {
+		if track, ok := c.tracks.lookup(id); ok {
+			return track.Name
+		}
+	}
+	if channel := ctx.Param("channel"); channel != "" {
+		return channel
+	}
+
+	id := ctx.Param("id")
+
+	return strings.TrimSuffix(id, path.Ext(id))
+}
+
+// streamPassword return what replaces the password in the user streams urls:
+// a token for the channel in tokens mode, the path escaped password otherwise.
+func (c *Config) streamPassword(user *users.User, channel string) string {
+	if c.tokens != nil {
+		return c.tokens.Sign(user.Name, channel)
+	}
+
+	return user.Password.PathEscape()
+}
+
+// requestUser return the user authenticated for the request.
+func requestUser(ctx *gin.Context) *users.User {
+	return ctx.MustGet(userKey).(*users.User)
+}
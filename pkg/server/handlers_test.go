@@ -0,0 +1,137 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// upstreamServer answer its status and body, after sending the headers and waiting
+// delay for a 200, or never when delay is negative.
+func upstreamServer(t *testing.T, status int, body string, delay time.Duration) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.(http.Flusher).Flush()
+		if delay < 0 {
+			<-r.Context().Done()
+			return
+		}
+		time.Sleep(delay)
+		w.Write([]byte(body)) // nolint: errcheck
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// streamThrough proxy the candidates urls with c.stream and return the client response.
+func streamThrough(t *testing.T, c *Config, candidates ...string) (int, string) {
+	urls := make([]*url.URL, 0, len(candidates))
+	for _, candidate := range candidates {
+		u, err := url.Parse(candidate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, u)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", func(ctx *gin.Context) {
+		c.stream(ctx, urls[0], urls[1:]...)
+	})
+	proxy := httptest.NewServer(r)
+	defer proxy.Close()
+
+	resp, err := http.Get(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.StatusCode, string(b)
+}
+
+func newFailoverConfig(timeout int) *Config {
+	return &Config{
+		ProxyConfig: &config.ProxyConfig{Failover: config.Failover{Timeout: timeout}},
+		sessions:    newSessionRegistry(),
+	}
+}
+
+func TestStreamFailover(t *testing.T) {
+	ok := upstreamServer(t, http.StatusOK, "main", 0)
+	backup := upstreamServer(t, http.StatusOK, "backup", 0)
+	notFound := upstreamServer(t, http.StatusNotFound, "not found", 0)
+	unavailable := upstreamServer(t, http.StatusServiceUnavailable, "unavailable", 0)
+	stalled := upstreamServer(t, http.StatusOK, "", -1)
+	slow := upstreamServer(t, http.StatusOK, "slow", 200*time.Millisecond)
+
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name       string
+		candidates []string
+		wantStatus int
+		wantBody   string
+	}{
+		{"first answering", []string{ok.URL, backup.URL}, http.StatusOK, "main"},
+		{"connect error", []string{down.URL, backup.URL}, http.StatusOK, "backup"},
+		{"non 2xx", []string{notFound.URL, backup.URL}, http.StatusOK, "backup"},
+		{"stalled first bytes", []string{stalled.URL, backup.URL}, http.StatusOK, "backup"},
+		{"slow within the timeout", []string{slow.URL, backup.URL}, http.StatusOK, "slow"},
+		{"several failures", []string{down.URL, notFound.URL, stalled.URL, backup.URL}, http.StatusOK, "backup"},
+		{"last returned as is", []string{notFound.URL, unavailable.URL}, http.StatusServiceUnavailable, "unavailable"},
+		{"no fallback", []string{notFound.URL}, http.StatusNotFound, "not found"},
+	}
+
+	c := newFailoverConfig(1)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, body := streamThrough(t, c, tt.candidates...)
+			if status != tt.wantStatus || body != tt.wantBody {
+				t.Errorf("stream() = %d %q, want %d %q", status, body, tt.wantStatus, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestStreamFailoverLastUnreachable(t *testing.T) {
+	notFound := upstreamServer(t, http.StatusNotFound, "not found", 0)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	if status, _ := streamThrough(t, newFailoverConfig(1), notFound.URL, down.URL); status != http.StatusInternalServerError {
+		t.Errorf("stream() status = %d, want %d", status, http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+)
+
+// probeTimeout is how long the status waits for each upstream.
+const probeTimeout = 5 * time.Second
+
+type sourceStatus struct {
+	Name           string     `json:"name"`
+	URL            string     `json:"url"`
+	Reachable      bool       `json:"reachable"`
+	Error          string     `json:"error,omitempty"`
+	LastRefresh    *time.Time `json:"last_refresh,omitempty"`
+	RefreshError   string     `json:"refresh_error,omitempty"`
+	Tracks         int        `json:"tracks"`
+	Connections    int        `json:"connections"`
+	MaxConnections int        `json:"max_connections"`
+}
+
+type providerStatus struct {
+	Name              string     `json:"name"`
+	BaseURL           string     `json:"base_url"`
+	Reachable         bool       `json:"reachable"`
+	Error             string     `json:"error,omitempty"`
+	Status            string     `json:"status,omitempty"`
+	Expiry            *time.Time `json:"expiry,omitempty"`
+	ActiveConnections int        `json:"active_connections"`
+	MaxConnections    int        `json:"max_connections"`
+	Connections       int        `json:"connections"`
+	LastPlaylist      *time.Time `json:"last_playlist_refresh,omitempty"`
+	LastEPG           *time.Time `json:"last_epg_refresh,omitempty"`
+}
+
+// healthRoutes register the probes of the orchestrators.
+func (c *Config) healthRoutes(r gin.IRoutes) {
+	r.GET("/healthz", c.healthz)
+	r.GET("/readyz", c.readyz)
+}
+
+// healthz answer as long as the server runs.
+func (c *Config) healthz(ctx *gin.Context) {
+	ctx.String(http.StatusOK, "ok")
+}
+
+// readyz answer 503 until the server serves a playlist, and once it is shutting down.
+func (c *Config) readyz(ctx *gin.Context) {
+	if reason := c.notReady(); reason != "" {
+		ctx.String(http.StatusServiceUnavailable, reason)
+		return
+	}
+
+	ctx.String(http.StatusOK, "ok")
+}
+
+// notReady return why the server can't serve the players, empty when it can.
+func (c *Config) notReady() string {
+	if atomic.LoadInt32(c.ready) == 0 {
+		return "not serving"
+	}
+
+	if len(c.sources) == 0 {
+		return ""
+	}
+	for _, s := range c.sources {
+		s.RLock()
+		loaded := !s.lastRefresh.IsZero()
+		s.RUnlock()
+		if loaded {
+			return ""
+		}
+	}
+
+	return "no m3u source loaded"
+}
+
+// status report the upstreams reachability, refreshes and connections.
+func (c *Config) status(ctx *gin.Context) {
+	probeCtx, cancel := context.WithTimeout(ctx.Request.Context(), probeTimeout)
+	defer cancel()
+
+	sources := make([]sourceStatus, len(c.sources))
+	providers := make([]providerStatus, len(c.xtreamProviders))
+
+	var wg sync.WaitGroup
+	for i := range c.sources {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sources[i] = c.sourceStatus(probeCtx, c.sources[i])
+		}(i)
+	}
+	for i := range c.xtreamProviders {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			providers[i] = c.providerStatus(probeCtx, c.xtreamProviders[i])
+		}(i)
+	}
+	wg.Wait()
+
+	ready := c.notReady()
+	ctx.JSON(http.StatusOK, gin.H{
+		"ready":            ready == "",
+		"not_ready_reason": ready,
+		"started":          c.started,
+		"uptime":           int64(time.Since(c.started).Seconds()),
+		"streams":          len(c.sessions.list()),
+		"sources":          sources,
+		"xtream_providers": providers,
+	})
+}
+
+func (c *Config) sourceStatus(ctx context.Context, s *m3uSource) sourceStatus {
+	s.RLock()
+	res := sourceStatus{
+		Name:           s.Name,
+		URL:            redactURL(s.URL),
+		LastRefresh:    optionalTime(s.lastRefresh),
+		Tracks:         len(s.tracks),
+		MaxConnections: s.MaxConnections,
+	}
+	if s.lastErr != nil {
+		res.RefreshError = logger.Redact(s.lastErr.Error())
+	}
+	s.RUnlock()
+
+	res.Connections = c.sessions.connections("source " + s.Name)
+
+	if err := s.probe(ctx); err != nil {
+		res.Error = logger.Redact(err.Error())
+	} else {
+		res.Reachable = true
+	}
+
+	return res
+}
+
+// probe check that the source playlist can be downloaded, without reading it.
+func (s *m3uSource) probe(ctx context.Context) error {
+	if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+		_, err := os.Stat(s.URL)
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", s.URL, nil)
+	if err != nil {
+		return err
+	}
+	if s.User != "" || s.Password != "" {
+		req.SetBasicAuth(s.User.String(), s.Password.String())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close() // nolint: errcheck
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (c *Config) providerStatus(ctx context.Context, p *xtreamProvider) providerStatus {
+	lastPlaylist, lastEPG := p.lastRefreshes()
+	res := providerStatus{
+		Name:         p.accountName(),
+		BaseURL:      p.BaseURL,
+		Connections:  c.sessions.connections("xtream " + p.accountName()),
+		LastPlaylist: optionalTime(lastPlaylist),
+		LastEPG:      optionalTime(lastEPG),
+	}
+
+	// the client doesn't take the context, give up waiting for it on timeout
+	type login struct {
+		res providerStatus
+		err error
+	}
+	done := make(chan login, 1)
+	go func() {
+		client, err := p.client("")
+		if err != nil {
+			done <- login{err: err}
+			return
+		}
+
+		var l login
+		l.res.Status = client.UserInfo.Status
+		l.res.ActiveConnections = int(client.UserInfo.ActiveConnections)
+		l.res.MaxConnections = int(client.UserInfo.MaxConnections)
+		if client.UserInfo.ExpDate != nil && !client.UserInfo.ExpDate.Time.IsZero() {
+			expiry := client.UserInfo.ExpDate.Time
+			l.res.Expiry = &expiry
+		}
+		done <- l
+	}()
+
+	select {
+	case l := <-done:
+		if l.err != nil {
+			res.Error = logger.Redact(l.err.Error())
+			break
+		}
+		res.Reachable = true
+		res.Status = l.res.Status
+		res.Expiry = l.res.Expiry
+		res.ActiveConnections = l.res.ActiveConnections
+		res.MaxConnections = l.res.MaxConnections
+	case <-ctx.Done():
+		res.Error = ctx.Err().Error()
+	}
+
+	return res
+}
+
+// optionalTime return nil for the zero time, omitted from the JSON.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
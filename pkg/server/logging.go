@@ -0,0 +1,163 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
+)
+
+// requestIDKey is the context key of the request identifier.
+const requestIDKey = "iptv-proxy-request-id"
+
+// requestIDHeader is the header giving the request identifier, kept when set by a reverse proxy.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// probeRoutes are the health routes, logged at the debug level when they succeed.
+var probeRoutes = map[string]bool{"/healthz": true, "/readyz": true}
+
+// redactedParams are the path parameters holding credentials.
+var redactedParams = map[string]bool{"password": true, "token": true}
+
+// requestLog identify each request and log it once served, with its credentials redacted.
+func (c *Config) requestLog(ctx *gin.Context) {
+	id := ctx.GetHeader(requestIDHeader)
+	if !validRequestID.MatchString(id) {
+		id = newRequestID()
+	}
+	ctx.Set(requestIDKey, id)
+	ctx.Header(requestIDHeader, id)
+
+	start := time.Now()
+	ctx.Next()
+
+	status := ctx.Writer.Status()
+	level := logger.LevelInfo
+	switch {
+	case status >= http.StatusInternalServerError:
+		level = logger.LevelError
+	case status >= http.StatusBadRequest:
+		level = logger.LevelWarn
+	case probeRoutes[ctx.FullPath()]:
+		// the orchestrators probe the server every few seconds
+		level = logger.LevelDebug
+	}
+
+	kv := []interface{}{
+		"method", ctx.Request.Method,
+		"path", redactedPath(ctx),
+		"status", status,
+		"duration", time.Since(start),
+		"client", ctx.ClientIP(),
+		"bytes", ctx.Writer.Size(),
+	}
+	if channel := c.streamChannel(ctx); channel != "" {
+		kv = append(kv, "channel", channel)
+	}
+	if errs := ctx.Errors.ByType(gin.ErrorTypePrivate); len(errs) > 0 {
+		kv = append(kv, "error", strings.Join(errs.Errors(), "; "))
+	}
+
+	requestLogger(ctx).Log(level, "request", kv...)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b) // nolint: errcheck
+
+	return hex.EncodeToString(b)
+}
+
+// redactedPath return the request path and query, without the credentials of the route parameters.
+func redactedPath(ctx *gin.Context) string {
+	segments := strings.Split(ctx.Request.URL.EscapedPath(), "/")
+	for _, p := range ctx.Params {
+		if !redactedParams[p.Key] {
+			continue
+		}
+		for i, s := range segments {
+			if s == url.PathEscape(p.Value) || s == p.Value {
+				segments[i] = logger.Redacted
+			}
+		}
+	}
+
+	path := strings.Join(segments, "/")
+	if ctx.Request.URL.RawQuery != "" {
+		path += "?" + ctx.Request.URL.RawQuery
+	}
+
+	return path
+}
+
+// requestLogger return the logger of a request, with its identifier and user.
+func requestLogger(ctx *gin.Context) *logger.Logger {
+	l := logger.With("request_id", ctx.GetString(requestIDKey))
+	if u, ok := ctx.Get(userKey); ok {
+		l = l.With("user", u.(*users.User).Name)
+	}
+
+	return l
+}
+
+// recovery answer 500 to the requests which panicked, logging the panic without the request dump.
+var recovery = gin.CustomRecoveryWithWriter(ioutil.Discard, func(ctx *gin.Context, err interface{}) {
+	requestLogger(ctx).Error("panic", "path", redactedPath(ctx), "error", fmt.Sprint(err), "stack", string(debug.Stack()))
+	ctx.AbortWithStatus(http.StatusInternalServerError)
+})
+
+// registerSecrets add the credentials of the configuration to the ones redacted from the logs.
+func registerSecrets(c *config.ProxyConfig) {
+	logger.AddSecret(c.XtreamPassword.String())
+	logger.AddSecret(c.StreamTokens.Secret)
+	for _, s := range c.M3USources {
+		logger.AddSecret(s.Password.String())
+		if u, err := url.Parse(s.URL); err == nil {
+			logger.AddSecret(u.Query().Get("password"))
+		}
+	}
+	for _, p := range c.XtreamProviders {
+		logger.AddSecret(p.Password.String())
+	}
+	for _, account := range c.Users {
+		addPasswordSecret(account.Password.String())
+	}
+}
+
+// addPasswordSecret redact a user password from the logs, unless it is hashed.
+func addPasswordSecret(password string) {
+	if !users.IsHash(password) {
+		logger.AddSecret(password)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptv_proxy_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "iptv_proxy_http_request_duration_seconds",
+		Help: "Duration of the HTTP requests by route, streams included.",
+	}, []string{"route"})
+	upstreamResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptv_proxy_upstream_responses_total",
+		Help: "Responses of the upstream streams by provider account and status code, \"error\" when the request failed.",
+	}, []string{"account", "code"})
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "iptv_proxy_upstream_latency_seconds",
+		Help: "Time until the upstream streams respond, by provider account.",
+	}, []string{"account"})
+	upstreamSessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iptv_proxy_upstream_sessions",
+		Help: "Upstream streams in progress by provider account.",
+	}, []string{"account"})
+	activeStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "iptv_proxy_active_streams",
+		Help: "Streams watched by user.",
+	}, []string{"user"})
+	streamedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptv_proxy_streamed_bytes_total",
+		Help: "Bytes sent to the players by user.",
+	}, []string{"user"})
+	channelBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptv_proxy_channel_streamed_bytes_total",
+		Help: "Bytes sent to the players by channel, with --metrics-channels.",
+	}, []string{"channel"})
+	sourceRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptv_proxy_source_refreshes_total",
+		Help: "Refreshes of the m3u sources by source and result.",
+	}, []string{"source", "result"})
+	xtreamCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptv_proxy_xtream_cache_requests_total",
+		Help: "Lookups of the generated Xtream playlists and of the player API lists by cache and result.",
+	}, []string{"cache", "result"})
+	xtreamAPIRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptv_proxy_xtream_api_requests_total",
+		Help: "Xtream player API requests by action and status code.",
+	}, []string{"action", "code"})
+	xtreamAPIDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "iptv_proxy_xtream_api_duration_seconds",
+		Help: "Duration of the Xtream player API requests by action.",
+	}, []string{"action"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		upstreamResponses,
+		upstreamLatency,
+		upstreamSessions,
+		activeStreams,
+		streamedBytes,
+		channelBytes,
+		sourceRefreshes,
+		xtreamCacheRequests,
+		xtreamAPIRequests,
+		xtreamAPIDuration,
+	)
+}
+
+// metricsHandler serve the metrics in the Prometheus text format.
+var metricsHandler = gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+// instrument count the requests by route.
+func instrument(ctx *gin.Context) {
+	start := time.Now()
+	ctx.Next()
+
+	route := ctx.FullPath()
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(route, ctx.Request.Method, strconv.Itoa(ctx.Writer.Status())).Inc()
+	httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+}
+
+// resultLabel is the result label of an error.
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+
+	return "success"
+}
+
+// cacheLabel is the result label of a cache lookup.
+func cacheLabel(hit bool) string {
+	if hit {
+		return "hit"
+	}
+
+	return "miss"
+}
+
+// observeXtreamAPI record a player API request, the unknown actions being counted together.
+func observeXtreamAPI(ctx *gin.Context, action string, start time.Time) {
+	switch {
+	case action == "":
+		action = "login"
+	case !xtreamapi.KnownAction(action):
+		action = "unknown"
+	}
+
+	xtreamAPIRequests.WithLabelValues(action, strconv.Itoa(ctx.Writer.Status())).Inc()
+	xtreamAPIDuration.WithLabelValues(action).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,365 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+)
+
+const (
+	// muxBufferSize is the max ring buffer size of each viewer of a shared stream,
+	// a viewer falling further behind is disconnected. The buffers start at
+	// muxInitialBufferSize and grow as needed.
+	muxBufferSize        = 8 << 20
+	muxInitialBufferSize = 2 * muxChunkSize
+	muxChunkSize         = 32 << 10
+
+	// the MPEG-TS packets, the late viewers start on a packet
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// streamMux share one upstream connection between the viewers of a same live channel.
+type streamMux struct {
+	// guards the channels map only, each channel has its own lock
+	sync.Mutex
+	channels map[string]*muxChannel
+}
+
+func newStreamMux() *streamMux {
+	return &streamMux{channels: map[string]*muxChannel{}}
+}
+
+// muxChannel is a shared upstream connection.
+type muxChannel struct {
+	key string
+	// closed once the upstream is opened
+	ready chan struct{}
+	resp  *http.Response
+	body  io.Reader
+	// shared is false when the upstream failed or isn't a live stream
+	shared bool
+
+	// set once the channel can't take new viewers, read without the lock
+	closed int32
+
+	// guards the viewers and the broadcast state
+	sync.Mutex
+	viewers map[*muxViewer]struct{}
+	// bytes broadcast, and if the stream starts as an MPEG-TS stream
+	offset int64
+	ts     bool
+}
+
+func (ch *muxChannel) isClosed() bool {
+	return atomic.LoadInt32(&ch.closed) == 1
+}
+
+// close mark the channel closed, it returns false if it already was.
+func (ch *muxChannel) close() bool {
+	return atomic.SwapInt32(&ch.closed, 1) == 0
+}
+
+// channel return the channel of key, owner is true when the caller
+// created it and has to open its upstream.
+func (m *streamMux) channel(key string) (ch *muxChannel, owner bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	if ch, ok := m.channels[key]; ok && !ch.isClosed() {
+		return ch, false
+	}
+
+	ch = &muxChannel{
+		key:     key,
+		ready:   make(chan struct{}),
+		viewers: map[*muxViewer]struct{}{},
+	}
+	m.channels[key] = ch
+
+	return ch, true
+}
+
+// opened publish the upstream response of a channel. Only live streams, without
+// length, are shared; other channels are removed so next viewers open their own.
+func (m *streamMux) opened(ch *muxChannel, resp *http.Response, body io.Reader) {
+	ch.resp, ch.body = resp, body
+	ch.shared = resp != nil && resp.StatusCode >= 200 && resp.StatusCode < 300 && resp.ContentLength < 0
+	if !ch.shared {
+		ch.close()
+		m.remove(ch)
+	}
+	close(ch.ready)
+}
+
+// attach a new viewer to a channel, nil if the channel is closed.
+func (m *streamMux) attach(ch *muxChannel) *muxViewer {
+	ch.Lock()
+	defer ch.Unlock()
+
+	if ch.isClosed() {
+		return nil
+	}
+
+	v := newMuxViewer()
+	ch.viewers[v] = struct{}{}
+
+	return v
+}
+
+// detach a viewer, the upstream is closed after the last one.
+func (m *streamMux) detach(ch *muxChannel, v *muxViewer) {
+	v.close()
+
+	ch.Lock()
+	delete(ch.viewers, v)
+	last := len(ch.viewers) == 0 && ch.close()
+	ch.Unlock()
+
+	if last {
+		m.remove(ch)
+		ch.resp.Body.Close() // nolint: errcheck
+	}
+}
+
+// remove a channel from the channels, unless it has been replaced.
+func (m *streamMux) remove(ch *muxChannel) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.channels[ch.key] == ch {
+		delete(m.channels, ch.key)
+	}
+}
+
+// pump copy the upstream data to the viewers until the upstream ends
+// or the last viewer leaves.
+func (m *streamMux) pump(ch *muxChannel) {
+	buf := make([]byte, muxChunkSize)
+	for {
+		n, err := ch.body.Read(buf)
+		if n > 0 {
+			ch.broadcast(buf[:n])
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	ch.Lock()
+	ch.close()
+	for v := range ch.viewers {
+		v.close()
+	}
+	ch.Unlock()
+
+	m.remove(ch)
+	ch.resp.Body.Close() // nolint: errcheck
+}
+
+// broadcast copy p into the buffers of the channel viewers.
+func (ch *muxChannel) broadcast(p []byte) {
+	ch.Lock()
+	defer ch.Unlock()
+
+	if ch.offset == 0 {
+		ch.ts = p[0] == tsSyncByte
+	}
+
+	for v := range ch.viewers {
+		data := p
+		if !v.synced {
+			i := ch.packetStart(p)
+			if i < 0 {
+				continue
+			}
+			v.synced = true
+			data = p[i:]
+		}
+		if !v.write(data) {
+			logger.Warn("shared stream viewer too slow, disconnected", "stream", ch.key)
+		}
+	}
+	ch.offset += int64(len(p))
+}
+
+// packetStart return the index of the first MPEG-TS packet starting in p, -1 if none,
+// so the viewers joining a stream in progress start on a packet. Other streams start anywhere.
+// It must be called with the channel lock held.
+func (ch *muxChannel) packetStart(p []byte) int {
+	if !ch.ts {
+		return 0
+	}
+
+	for i := int((tsPacketSize - ch.offset%tsPacketSize) % tsPacketSize); i < len(p); i += tsPacketSize {
+		if p[i] == tsSyncByte {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// muxViewer is the ring buffer of a viewer of a shared stream.
+type muxViewer struct {
+	sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	start  int
+	size   int
+	closed bool
+
+	// guarded by the channel lock, true once the viewer receives data
+	synced bool
+}
+
+func newMuxViewer() *muxViewer {
+	v := &muxViewer{buf: make([]byte, muxInitialBufferSize)}
+	v.cond = sync.NewCond(&v.Mutex)
+
+	return v
+}
+
+// write append p to the buffer, the viewer is closed when it overflows.
+func (v *muxViewer) write(p []byte) bool {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.closed {
+		return true
+	}
+
+	if v.size+len(p) > len(v.buf) {
+		if v.size+len(p) > muxBufferSize {
+			v.closed = true
+			v.cond.Broadcast()
+			return false
+		}
+		v.grow(v.size + len(p))
+	}
+
+	end := (v.start + v.size) % len(v.buf)
+	n := copy(v.buf[end:], p)
+	copy(v.buf, p[n:])
+	v.size += len(p)
+	v.cond.Broadcast()
+
+	return true
+}
+
+// grow the buffer to hold n bytes, doubling its size up to muxBufferSize.
+// It must be called with the lock held.
+func (v *muxViewer) grow(n int) {
+	size := 2 * len(v.buf)
+	for size < n {
+		size *= 2
+	}
+	if size > muxBufferSize {
+		size = muxBufferSize
+	}
+
+	buf := make([]byte, size)
+	k := copy(buf[:v.size], v.buf[v.start:])
+	copy(buf[k:v.size], v.buf)
+	v.buf, v.start = buf, 0
+}
+
+// Read block until data is buffered, it returns io.EOF once the viewer is closed and drained.
+func (v *muxViewer) Read(p []byte) (int, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	for v.size == 0 && !v.closed {
+		v.cond.Wait()
+	}
+
+	if v.size == 0 {
+		return 0, io.EOF
+	}
+
+	n := v.size
+	if n > len(p) {
+		n = len(p)
+	}
+	if v.start+n > len(v.buf) {
+		n = len(v.buf) - v.start
+	}
+	copy(p, v.buf[v.start:v.start+n])
+	v.start = (v.start + n) % len(v.buf)
+	v.size -= n
+
+	return n, nil
+}
+
+func (v *muxViewer) close() {
+	v.Lock()
+	defer v.Unlock()
+
+	v.closed = true
+	v.cond.Broadcast()
+}
+
+// muxStream attach the client to the shared upstream connection of the channel,
+// the first viewer opens it.
+func (c *Config) muxStream(ctx *gin.Context, candidates []*url.URL) {
+	ch, owner := c.mux.channel(candidates[0].String())
+
+	var viewer *muxViewer
+	if owner {
+		resp, body, err := c.openUpstream(ctx, candidates)
+		c.mux.opened(ch, resp, body)
+		if err != nil {
+			abortStream(ctx, err)
+			return
+		}
+
+		if !ch.shared {
+			defer resp.Body.Close()
+			copyResponse(ctx, resp, body)
+			return
+		}
+
+		viewer = c.mux.attach(ch)
+		go c.mux.pump(ch)
+	} else {
+		<-ch.ready
+		viewer = c.mux.attach(ch)
+	}
+
+	if viewer == nil {
+		c.stream(ctx, candidates[0], candidates[1:]...)
+		return
+	}
+	defer c.mux.detach(ch, viewer)
+
+	// unblock the viewer when the client leaves
+	go func() {
+		<-ctx.Request.Context().Done()
+		viewer.close()
+	}()
+
+	copyResponse(ctx, ch.resp, viewer)
+}
@@ -0,0 +1,160 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/playlist"
+)
+
+// channelOverride is a change of a channel made from the dashboard,
+// the empty fields are left as in the playlist.
+type channelOverride struct {
+	Disabled bool   `json:"disabled,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Logo     string `json:"logo,omitempty"`
+	Group    string `json:"group,omitempty"`
+}
+
+// overrideStore keep the channels overrides by track identifier,
+// persisted in path (if not empty) to survive restarts.
+type overrideStore struct {
+	sync.RWMutex
+	path string
+
+	Channels map[string]channelOverride `json:"channels"`
+}
+
+func loadOverrideStore(path string) (*overrideStore, error) {
+	s := &overrideStore{path: path, Channels: map[string]channelOverride{}}
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("channel overrides file %q: %w", path, err)
+	}
+	if s.Channels == nil {
+		s.Channels = map[string]channelOverride{}
+	}
+
+	return s, nil
+}
+
+func (s *overrideStore) get(id string) (channelOverride, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	o, ok := s.Channels[id]
+
+	return o, ok
+}
+
+// disabled tell if the channel is turned off.
+func (s *overrideStore) disabled(id string) bool {
+	o, _ := s.get(id)
+
+	return o.Disabled
+}
+
+// set the override of a channel, an empty one removes it.
+func (s *overrideStore) set(id string, o channelOverride) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if o == (channelOverride{}) {
+		delete(s.Channels, id)
+	} else {
+		s.Channels[id] = o
+	}
+
+	return s.save()
+}
+
+// apply the names, logos and groups overrides, ids[i] being the identifier of tracks[i].
+// The given tracks are left untouched.
+func (s *overrideStore) apply(tracks []m3u.Track, ids []string) []m3u.Track {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.Channels) == 0 {
+		return tracks
+	}
+
+	res := make([]m3u.Track, len(tracks))
+	for i := range tracks {
+		res[i] = tracks[i]
+
+		o, ok := s.Channels[ids[i]]
+		if !ok {
+			continue
+		}
+		res[i].Tags = append([]m3u.Tag(nil), tracks[i].Tags...)
+
+		if o.Name != "" {
+			playlist.SetField(&res[i], playlist.NameField, o.Name)
+		}
+		if o.Logo != "" {
+			playlist.SetField(&res[i], "tvg-logo", o.Logo)
+		}
+		if o.Group != "" {
+			playlist.SetField(&res[i], "group-title", o.Group)
+		}
+	}
+
+	return res
+}
+
+// save must be called with the lock held.
+func (s *overrideStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
@@ -20,22 +20,22 @@ package server
 
 import (
 	"fmt"
-	"path"
-	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
 func (c *Config) routes(r *gin.RouterGroup) {
 	r = r.Group(c.CustomEndpoint)
+	c.adminRoutes(r)
+
+	if len(c.xtreamProviders) > 0 || len(c.EPGSources) > 0 {
+		r.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
+	}
 
 	//Xtream service endopoints
-	if c.ProxyConfig.XtreamBaseURL != "" {
+	if len(c.xtreamProviders) > 0 {
 		c.xtreamRoutes(r)
-		if strings.Contains(c.XtreamBaseURL, c.RemoteURL.Host) &&
-			c.XtreamUser.String() == c.RemoteURL.Query().Get("username") &&
-			c.XtreamPassword.String() == c.RemoteURL.Query().Get("password") {
-
+		if c.XtreamGetAuto() {
 			r.GET("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
 			// XXX Private need: for external Android app
 			r.POST("/"+c.M3UFileName, c.authenticate, c.xtreamGetAuto)
@@ -57,13 +57,12 @@ func (c *Config) xtreamRoutes(r *gin.RouterGroup) {
 	r.GET("/apiget", c.authenticate, c.xtreamApiGet)
 	r.GET("/player_api.php", c.authenticate, c.xtreamPlayerAPIGET)
 	r.POST("/player_api.php", c.appAuthenticate, c.xtreamPlayerAPIPOST)
-	r.GET("/xmltv.php", c.authenticate, c.xtreamXMLTV)
-	r.GET(fmt.Sprintf("/%s/%s/:id", c.User, c.Password), c.xtreamStreamHandler)
-	r.GET(fmt.Sprintf("/live/%s/%s/:id", c.User, c.Password), c.xtreamStreamLive)
-	r.GET(fmt.Sprintf("/timeshift/%s/%s/:duration/:start/:id", c.User, c.Password), c.xtreamStreamTimeshift)
-	r.GET(fmt.Sprintf("/movie/%s/%s/:id", c.User, c.Password), c.xtreamStreamMovie)
-	r.GET(fmt.Sprintf("/series/%s/%s/:id", c.User, c.Password), c.xtreamStreamSeries)
-	r.GET(fmt.Sprintf("/hlsr/:token/%s/%s/:channel/:hash/:chunk", c.User, c.Password), c.xtreamHlsrStream)
+	r.GET("/:username/:password/:id", c.xtreamStreamAuthenticate, c.countStream, c.xtreamStreamHandler)
+	r.GET("/live/:username/:password/:id", c.xtreamStreamAuthenticate, c.countStream, c.xtreamStreamLive)
+	r.GET("/timeshift/:username/:password/:duration/:start/:id", c.xtreamStreamAuthenticate, c.countStream, c.xtreamStreamTimeshift)
+	r.GET("/movie/:username/:password/:id", c.xtreamStreamAuthenticate, c.countStream, c.xtreamStreamMovie)
+	r.GET("/series/:username/:password/:id", c.xtreamStreamAuthenticate, c.countStream, c.xtreamStreamSeries)
+	r.GET("/hlsr/:token/:username/:password/:channel/:hash/:chunk", c.streamAuthenticate, c.countStream, c.xtreamHlsrStream)
 	r.GET("/hls/:token/:chunk", c.xtreamHlsStream)
 	r.GET("/play/:token/:type", c.xtreamStreamPlay)
 }
@@ -73,16 +72,5 @@ func (c *Config) m3uRoutes(r *gin.RouterGroup) {
 	// XXX Private need: for external Android app
 	r.POST("/"+c.M3UFileName, c.authenticate, c.getM3U)
 
-	for i, track := range c.playlist.Tracks {
-		trackConfig := &Config{
-			ProxyConfig: c.ProxyConfig,
-			track:       &c.playlist.Tracks[i],
-		}
-
-		if strings.HasSuffix(track.URI, ".m3u8") {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/:id", c.endpointAntiColision, c.User, c.Password, i), trackConfig.m3u8ReverseProxy)
-		} else {
-			r.GET(fmt.Sprintf("/%s/%s/%s/%d/%s", c.endpointAntiColision, c.User, c.Password, i, path.Base(track.URI)), trackConfig.reverseProxy)
-		}
-	}
+	r.GET(fmt.Sprintf("/%s/:username/:password/:track/:id", c.endpointAntiColision), c.streamAuthenticate, c.countStream, c.trackProxy)
 }
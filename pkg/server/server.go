@@ -20,60 +20,200 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/gin-contrib/cors"
 	"github.com/jamesnetherton/m3u"
 	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/playlist"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
 	uuid "github.com/satori/go.uuid"
 
 	"github.com/gin-gonic/gin"
 )
 
-var defaultProxyfiedM3UPath = filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
 var endpointAntiColision = strings.Split(uuid.NewV4().String(), "-")[0]
 
+var defaultProxyfiedM3UPath = filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
+
+// defaultTokenTTL is the validity of the stream tokens by default.
+const defaultTokenTTL = 24 * time.Hour
+
 // Config represent the server configuration
 type Config struct {
 	*config.ProxyConfig
 
 	// M3U service part
-	playlist *m3u.Playlist
-	// this variable is set only for m3u proxy endpoints
-	track *m3u.Track
+	// upstream playlists merged into the proxyfied playlist
+	sources []*m3uSource
+	// serialize the playlist rebuilds triggered by the sources refreshes
+	playlistLock *sync.Mutex
+	// tracks served by the m3u proxy endpoints
+	tracks    *trackIndex
+	trackIDs  *trackIDStore
+	overrides *overrideStore
 	// path to the proxyfied m3u file
 	proxyfiedM3UPath string
+	// accounts of the proxy
+	users *users.Store
+	// signer of the stream tokens, nil when the urls contain the passwords
+	tokens *users.Signer
+	access *accessGuard
 
 	endpointAntiColision string
+
+	// filter, dedup, rewrite rules and order applied on the proxyfied playlists
+	filter   *playlist.Filter
+	dedup    *playlist.Deduplicator
+	backups  *playlist.Backups
+	rewriter *playlist.Rewriter
+	orderer  *playlist.Orderer
+
+	// shared upstream connections of the live streams, nil when disabled
+	mux *streamMux
+	// upstream streams in progress
+	sessions *sessionRegistry
+
+	started time.Time
+	// set to 1 while the server accepts the players requests, updated atomically
+	ready *int32
+
+	// Xtream service part
+	xtreamProviders []*xtreamProvider
 }
 
 // NewServer initialize a new server configuration
 func NewServer(config *config.ProxyConfig) (*Config, error) {
-	var p m3u.Playlist
-	if config.RemoteURL.String() != "" {
-		var err error
-		p, err = m3u.Parse(config.RemoteURL.String())
-		if err != nil {
+	registerSecrets(config)
+
+	// the m3u sources aren't served when the Xtream get.php playlist replaces the m3u one
+	if config.XtreamGetAuto() && len(config.M3USources) > 1 {
+		return nil, errors.New("m3u-sources can't be added to an m3u url being the Xtream get.php playlist, which is served alone")
+	}
+
+	sources := make([]*m3uSource, 0, len(config.M3USources))
+	for i := range config.M3USources {
+		source := newM3USource(config.M3USources[i])
+		if err := source.refresh(); err != nil {
+			if len(config.M3USources) == 1 {
+				return nil, err
+			}
+			logger.Error("source", "source", source.Name, "error", err)
+		}
+		sources = append(sources, source)
+	}
+
+	filter, err := playlist.NewFilter(config.Filters)
+	if err != nil {
+		return nil, err
+	}
+
+	dedup, err := playlist.NewDeduplicator(config.Dedup)
+	if err != nil {
+		return nil, err
+	}
+
+	backups, err := playlist.NewBackups(config.Failover.Backups)
+	if err != nil {
+		return nil, err
+	}
+
+	rewriter, err := playlist.NewRewriter(config.Rewrites)
+	if err != nil {
+		return nil, err
+	}
+
+	orderer, err := playlist.NewOrderer(config.Order, config.Numbering)
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Connections.Policy {
+	case "", connectionsReject, connectionsQueue, connectionsPreempt:
+	default:
+		return nil, fmt.Errorf("connections: unknown policy %q", config.Connections.Policy)
+	}
+
+	userStore, err := users.NewStore(config.Users)
+	if err != nil {
+		return nil, err
+	}
+	if config.UsageFile != "" {
+		if err := userStore.LoadUsage(config.UsageFile); err != nil {
 			return nil, err
 		}
 	}
 
-        if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
-                endpointAntiColision = trimmedCustomId
-        }
+	var tokens *users.Signer
+	if config.StreamTokens.Enabled {
+		ttl := time.Duration(config.StreamTokens.TTL) * time.Hour
+		if ttl <= 0 {
+			ttl = defaultTokenTTL
+		}
+		if tokens, err = users.NewSigner(config.StreamTokens.Secret, ttl); err != nil {
+			return nil, err
+		}
+	}
+
+	access, err := newAccessGuard(config.Access)
+	if err != nil {
+		return nil, err
+	}
+
+	trackIDs, err := loadTrackIDStore(config.TrackIDsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides, err := loadOverrideStore(config.ChannelOverridesFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmedCustomId := strings.Trim(config.CustomId, "/"); trimmedCustomId != "" {
+		endpointAntiColision = trimmedCustomId
+	} else if endpointAntiColision, err = trackIDs.setEndpoint(endpointAntiColision); err != nil {
+		return nil, err
+	}
+
+	var mux *streamMux
+	if config.StreamMux {
+		mux = newStreamMux()
+	}
 
 	return &Config{
-		config,
-		&p,
-		nil,
-		defaultProxyfiedM3UPath,
-		endpointAntiColision,
+		ProxyConfig:          config,
+		sources:              sources,
+		playlistLock:         &sync.Mutex{},
+		tracks:               newTrackIndex(),
+		trackIDs:             trackIDs,
+		overrides:            overrides,
+		proxyfiedM3UPath:     defaultProxyfiedM3UPath,
+		users:                userStore,
+		tokens:               tokens,
+		access:               access,
+		endpointAntiColision: endpointAntiColision,
+		filter:               filter,
+		dedup:                dedup,
+		backups:              backups,
+		rewriter:             rewriter,
+		orderer:              orderer,
+		mux:                  mux,
+		sessions:             newSessionRegistry(),
+		started:              time.Now(),
+		ready:                new(int32),
+		xtreamProviders:      newXtreamProviders(config.XtreamProviders),
 	}, nil
 }
 
@@ -83,35 +223,243 @@ func (c *Config) Serve() error {
 		return err
 	}
 
-	router := gin.Default()
-	router.Use(cors.Default())
+	for _, source := range c.sources {
+		if source.RefreshInterval > 0 {
+			go c.sourceRefresher(source, time.Duration(source.RefreshInterval)*time.Minute)
+		}
+	}
+	if c.UsageFile != "" {
+		go c.usageSaver(usageSaveInterval)
+	}
+
+	router := gin.New()
+	if err := router.SetTrustedProxies(c.Access.TrustedProxies); err != nil {
+		return err
+	}
+	router.Use(c.requestLog, recovery, instrument, c.cors())
+	// the probes answer any client, they are registered before the access control
+	c.healthRoutes(router)
+	router.Use(c.accessControl)
+	router.GET("/status", c.adminAuthenticate, c.status)
+	if c.Metrics {
+		router.GET("/metrics", c.adminAuthenticate, metricsHandler)
+	}
 	group := router.Group("/")
 	c.routes(group)
 
-	return router.Run(fmt.Sprintf(":%d", c.HostConfig.Port))
+	var servers []*http.Server
+	if c.TLSCert == "" || c.TLSPort != 0 {
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf(":%d", c.HostConfig.Port),
+			Handler: router,
+		})
+	}
+	if c.TLSCert != "" {
+		certs, err := newCertReloader(c.TLSCert, c.TLSKey)
+		if err != nil {
+			return err
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go certs.watch(done)
+
+		port := c.TLSPort
+		if port == 0 {
+			port = c.HostConfig.Port
+		}
+		servers = append(servers, &http.Server{
+			Addr:    fmt.Sprintf(":%d", port),
+			Handler: router,
+			TLSConfig: &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: certs.getCertificate,
+			},
+		})
+	}
+
+	return c.serve(servers)
 }
 
 func (c *Config) playlistInitialization() error {
-	if len(c.playlist.Tracks) == 0 {
+	if len(c.sources) == 0 {
 		return nil
 	}
 
-	f, err := os.Create(c.proxyfiedM3UPath)
+	return c.rebuildPlaylist()
+}
+
+// sourceRefresher periodically re-fetch an upstream playlist.
+func (c *Config) sourceRefresher(source *m3uSource, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := source.refresh(); err != nil {
+			logger.Error("source refresh", "source", source.Name, "error", err)
+			continue
+		}
+
+		if err := c.rebuildPlaylist(); err != nil {
+			logger.Error("playlist rebuild", "error", err)
+			continue
+		}
+		logger.Info("source refreshed", "source", source.Name, "tracks", c.tracks.len())
+	}
+}
+
+// usageSaveInterval is how often the users usage is saved into the usage file.
+const usageSaveInterval = time.Minute
+
+// usageSaver periodically save the users usage, so it survives a restart.
+func (c *Config) usageSaver(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		c.saveUsage()
+	}
+}
+
+// saveUsage write the users usage into the usage file, if any.
+func (c *Config) saveUsage() {
+	if c.UsageFile == "" {
+		return
+	}
+
+	if err := c.users.SaveUsage(c.UsageFile); err != nil {
+		logger.Error("usage file", "file", c.UsageFile, "error", err)
+	}
+}
+
+// rebuildPlaylist merge the sources playlists, process them, swap the tracks served
+// by the m3u endpoints and the proxyfied m3u file. Requests already running keep
+// the track they started with.
+func (c *Config) rebuildPlaylist() error {
+	c.playlistLock.Lock()
+	defer c.playlistLock.Unlock()
+
+	tracks, ids, alternates, err := c.processPlaylist(mergeSources(c.sources).Tracks, false)
+	if err != nil {
+		return err
+	}
+
+	c.tracks.replace(tracks, ids, alternates)
+
+	return c.writePlaylist(c.proxyfiedM3UPath, tracks, ids)
+}
+
+// writePlaylist marshall the playlist of the first account into a temporary file
+// and move it to path, so readers never see a partially written file.
+func (c *Config) writePlaylist(path string, tracks []m3u.Track, ids []string) error {
+	if len(c.Users) == 0 {
+		return nil
+	}
+	user, ok := c.users.Get(c.Users[0].Username)
+	if !ok {
+		return nil
+	}
+
+	tmpPath := path + ".tmp"
+
+	f, err := os.Create(tmpPath)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 
-	return c.marshallInto(f, false)
+	c.marshallInto(f, tracks, ids, &user, false)
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath) // nolint: errcheck
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
+
+// processPlaylist apply the filters, dedup, rewrite rules and order to the tracks.
+// For the m3u endpoints, the tracks identifiers and fallback URIs are assigned.
+func (c *Config) processPlaylist(tracks []m3u.Track, xtream bool) ([]m3u.Track, []string, map[string][]string, error) {
+	tracks = c.filter.Apply(tracks)
+
+	keep, variants := c.dedup.Groups(tracks)
+	deduped := make([]m3u.Track, 0, len(keep))
+	for _, i := range keep {
+		deduped = append(deduped, tracks[i])
+	}
+
+	filteredTrack := make([]m3u.Track, 0, len(deduped))
+
+	var ids, filteredIDs []string
+	if !xtream {
+		var err error
+		ids, err = c.trackIDs.assign(deduped)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		filteredIDs = make([]string, 0, len(ids))
+	}
+
+	// duplicated tracks first, then the configured backups
+	alternates := map[string][]string{}
+	if !xtream {
+		for i, variant := range variants {
+			if c.dedup.Failover() {
+				for _, j := range variant {
+					alternates[ids[i]] = append(alternates[ids[i]], tracks[j].URI)
+				}
+			}
+			if urls := c.backups.URLs(&deduped[i]); len(urls) > 0 {
+				alternates[ids[i]] = append(alternates[ids[i]], urls...)
+			}
+		}
+	}
+	tracks = deduped
+
+	// rewrite after the identifiers are assigned, so they don't depend on the rules
+	tracks = c.rewriter.Apply(tracks)
+	if !xtream {
+		tracks = c.overrides.apply(tracks, ids)
+	}
+
+	// the Xtream live tracks are numbered like the get_live_streams channels
+	if xtream {
+		tracks, _ = c.orderer.Sort(tracks)
+	} else {
+		var order []int
+		tracks, order = c.orderer.Apply(tracks)
+		sortedIDs := make([]string, len(order))
+		for i, j := range order {
+			sortedIDs[i] = ids[j]
+		}
+		ids = sortedIDs
+	}
+
+	for i, track := range tracks {
+		if _, err := url.Parse(track.URI); err != nil {
+			logger.Error("invalid track url", "track", track.Name, "error", err)
+			continue
+		}
+
+		filteredTrack = append(filteredTrack, track)
+		if !xtream {
+			filteredIDs = append(filteredIDs, ids[i])
+		}
+	}
+	return filteredTrack, filteredIDs, alternates, nil
 }
 
-// MarshallInto a *bufio.Writer a Playlist.
-func (c *Config) marshallInto(into *os.File, xtream bool) error {
-	filteredTrack := make([]m3u.Track, 0, len(c.playlist.Tracks))
+// marshallInto write the tracks of the groups allowed to the user, with the user credentials
+// in their urls. ids are the tracks identifiers for the m3u endpoints.
+func (c *Config) marshallInto(into io.Writer, tracks []m3u.Track, ids []string, user *users.User, xtream bool) {
+	io.WriteString(into, "#EXTM3U\n") // nolint: errcheck
+	for i, track := range tracks {
+		if !user.Allowed(playlist.Field(&track, "group-title")) {
+			continue
+		}
+		if !xtream && c.overrides.disabled(ids[i]) {
+			continue
+		}
 
-	ret := 0
-	into.WriteString("#EXTM3U\n") // nolint: errcheck
-	for i, track := range c.playlist.Tracks {
 		var buffer bytes.Buffer
 
 		buffer.WriteString("#EXTINF:")                       // nolint: errcheck
@@ -124,24 +472,23 @@ func (c *Config) marshallInto(into *os.File, xtream bool) error {
 			buffer.WriteString(fmt.Sprintf("%s=%q ", track.Tags[i].Name, track.Tags[i].Value)) // nolint: errcheck
 		}
 
-		uri, err := c.replaceURL(track.URI, i-ret, xtream)
+		var trackID string
+		if !xtream {
+			trackID = ids[i]
+		}
+
+		uri, err := c.replaceURL(track.URI, trackID, user, xtream)
 		if err != nil {
-			ret++
-			log.Printf("ERROR: track: %s: %s", track.Name, err)
+			logger.Error("invalid track url", "track", track.Name, "error", err)
 			continue
 		}
 
-		into.WriteString(fmt.Sprintf("%s, %s\n%s\n", buffer.String(), track.Name, uri)) // nolint: errcheck
-
-		filteredTrack = append(filteredTrack, track)
+		io.WriteString(into, fmt.Sprintf("%s, %s\n%s\n", buffer.String(), track.Name, uri)) // nolint: errcheck
 	}
-	c.playlist.Tracks = filteredTrack
-
-	return into.Sync()
 }
 
 // ReplaceURL replace original playlist url by proxy url
-func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, error) {
+func (c *Config) replaceURL(uri string, trackID string, user *users.User, xtream bool) (string, error) {
 	oriURL, err := url.Parse(uri)
 	if err != nil {
 		return "", err
@@ -159,10 +506,11 @@ func (c *Config) replaceURL(uri string, trackIndex int, xtream bool) (string, er
 
 	uriPath := oriURL.EscapedPath()
 	if xtream {
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamUser.PathEscape(), c.User.PathEscape())
-		uriPath = strings.ReplaceAll(uriPath, c.XtreamPassword.PathEscape(), c.Password.PathEscape())
+		if uriPath, err = c.xtreamProxyPath(oriURL, user); err != nil {
+			return "", err
+		}
 	} else {
-		uriPath = path.Join("/", c.endpointAntiColision, c.User.PathEscape(), c.Password.PathEscape(), fmt.Sprintf("%d", trackIndex), path.Base(uriPath))
+		uriPath = path.Join("/", c.endpointAntiColision, url.PathEscape(user.Name), c.streamPassword(user, trackID), trackID, path.Base(uriPath))
 	}
 
 	basicAuth := oriURL.User.String()
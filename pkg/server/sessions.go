@@ -0,0 +1,353 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
+)
+
+// Policies applied when a provider account has no connection left.
+const (
+	connectionsReject  = "reject"
+	connectionsQueue   = "queue"
+	connectionsPreempt = "preempt"
+)
+
+// defaultQueueTimeout is how long a queued stream waits for a connection by default.
+const defaultQueueTimeout = 30 * time.Second
+
+// maxConnectionsError is returned when a provider account has no connection left.
+type maxConnectionsError struct {
+	account string
+	max     int
+}
+
+func (e *maxConnectionsError) Error() string {
+	return fmt.Sprintf("%s: max connections reached (%d)", e.account, e.max)
+}
+
+// session is an upstream stream in progress.
+type session struct {
+	id uint64
+	// account is the provider account used by the stream, empty when unknown
+	account string
+	url     string
+	// user of the proxy who opened the stream and the channel watched
+	user     string
+	channel  string
+	client   string
+	priority int
+	started  time.Time
+	// bytes received from the upstream, updated atomically
+	bytes  *int64
+	cancel context.CancelFunc
+}
+
+// sessionRegistry keep track of the upstream streams.
+type sessionRegistry struct {
+	sync.Mutex
+	nextID   uint64
+	sessions map[uint64]*session
+	// closed and replaced each time a session ends, to wake up the queued streams
+	released chan struct{}
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions: map[uint64]*session{},
+		released: make(chan struct{}),
+	}
+}
+
+// acquire register s once its account has a connection available, max being
+// the account limit, 0 for no limit. The policy tells whether to fail, wait
+// for a connection until done or the queue timeout, or stop an older session.
+func (r *sessionRegistry) acquire(done <-chan struct{}, s *session, max int, policy string, queueTimeout time.Duration) error {
+	var timeout <-chan time.Time
+	if policy == connectionsQueue {
+		timer := time.NewTimer(queueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		r.Lock()
+		if max <= 0 || s.account == "" || r.count(s.account) < max {
+			r.add(s)
+			r.Unlock()
+			return nil
+		}
+
+		switch policy {
+		case connectionsQueue:
+			released := r.released
+			r.Unlock()
+
+			select {
+			case <-released:
+			case <-timeout:
+				return &maxConnectionsError{s.account, max}
+			case <-done:
+				return context.Canceled
+			}
+		case connectionsPreempt:
+			victim := r.victim(s)
+			if victim == nil {
+				r.Unlock()
+				return &maxConnectionsError{s.account, max}
+			}
+			r.remove(victim)
+			r.add(s)
+			r.Unlock()
+
+			victim.cancel()
+			logger.Info("stream preempted", "account", s.account, "preempted_user", victim.user, "preempted_client", victim.client, "user", s.user, "client", s.client)
+			return nil
+		default:
+			r.Unlock()
+			return &maxConnectionsError{s.account, max}
+		}
+	}
+}
+
+// release unregister a session and stop its stream, it can be called several times.
+func (r *sessionRegistry) release(s *session) {
+	s.cancel()
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.remove(s)
+}
+
+// list return a copy of the sessions in progress.
+func (r *sessionRegistry) list() []session {
+	r.Lock()
+	defer r.Unlock()
+
+	res := make([]session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		res = append(res, *s)
+	}
+
+	return res
+}
+
+// connections return the number of sessions of an account.
+func (r *sessionRegistry) connections(account string) int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.count(account)
+}
+
+// kill stop the stream of a session, it returns false when the session doesn't exist.
+func (r *sessionRegistry) kill(id uint64) bool {
+	r.Lock()
+	s, ok := r.sessions[id]
+	if ok {
+		r.remove(s)
+	}
+	r.Unlock()
+
+	if ok {
+		s.cancel()
+	}
+
+	return ok
+}
+
+// killAll stop the streams of all the sessions and return how many there were.
+func (r *sessionRegistry) killAll() int {
+	r.Lock()
+	sessions := make([]*session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+		r.remove(s)
+	}
+	r.Unlock()
+
+	for _, s := range sessions {
+		s.cancel()
+	}
+
+	return len(sessions)
+}
+
+// add must be called with the lock held.
+func (r *sessionRegistry) add(s *session) {
+	r.nextID++
+	s.id = r.nextID
+	s.started = time.Now()
+	r.sessions[s.id] = s
+	upstreamSessions.WithLabelValues(s.account).Add(1)
+}
+
+// remove must be called with the lock held.
+func (r *sessionRegistry) remove(s *session) {
+	if _, ok := r.sessions[s.id]; !ok {
+		return
+	}
+
+	delete(r.sessions, s.id)
+	upstreamSessions.WithLabelValues(s.account).Add(-1)
+	close(r.released)
+	r.released = make(chan struct{})
+}
+
+// count must be called with the lock held.
+func (r *sessionRegistry) count(account string) int {
+	var n int
+	for _, s := range r.sessions {
+		if s.account == account {
+			n++
+		}
+	}
+
+	return n
+}
+
+// victim return the session of the same account to preempt: the oldest with
+// the lowest priority, never one with a higher priority than s.
+// It must be called with the lock held.
+func (r *sessionRegistry) victim(s *session) *session {
+	var victim *session
+	for _, v := range r.sessions {
+		if v.account != s.account || v.priority > s.priority {
+			continue
+		}
+		if victim == nil || v.priority < victim.priority ||
+			v.priority == victim.priority && v.started.Before(victim.started) {
+			victim = v
+		}
+	}
+
+	return victim
+}
+
+// sessionBody count the bytes received for the session of an upstream response
+// and release it when closed.
+type sessionBody struct {
+	io.ReadCloser
+	bytes   *int64
+	release func()
+}
+
+func (b *sessionBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.bytes, int64(n))
+
+	return n, err
+}
+
+func (b *sessionBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+
+	return err
+}
+
+// openSession register the upstream stream of u, waiting for a connection
+// of its provider account according to the connections policy.
+// The returned context is canceled when the session ends or is preempted.
+func (c *Config) openSession(ctx *gin.Context, u *url.URL) (*session, context.Context, error) {
+	account, max := c.streamAccount(u)
+
+	// the hls chunks and play tokens are not authenticated, their priority is 0
+	var user string
+	var priority int
+	if u, ok := ctx.Get(userKey); ok {
+		user = u.(*users.User).Name
+		priority = u.(*users.User).Priority
+	}
+
+	sessCtx, cancel := context.WithCancel(context.Background())
+	s := &session{
+		account:  account,
+		url:      u.Redacted(),
+		user:     user,
+		channel:  c.streamChannel(ctx),
+		client:   ctx.ClientIP(),
+		priority: priority,
+		bytes:    new(int64),
+		cancel:   cancel,
+	}
+
+	queueTimeout := defaultQueueTimeout
+	if c.Connections.QueueTimeout > 0 {
+		queueTimeout = time.Duration(c.Connections.QueueTimeout) * time.Second
+	}
+
+	if err := c.sessions.acquire(ctx.Request.Context().Done(), s, max, c.Connections.Policy, queueTimeout); err != nil {
+		cancel()
+		return nil, nil, err
+	}
+
+	return s, sessCtx, nil
+}
+
+// streamAccount return the provider account of a stream url and its connections limit.
+func (c *Config) streamAccount(u *url.URL) (string, int) {
+	if p := c.xtreamProviderOf(u); p != nil {
+		return "xtream " + p.accountName(), p.maxConnections()
+	}
+
+	for _, s := range c.sources {
+		if s.MaxConnections > 0 && s.hasHost(u.Host) {
+			return "source " + s.Name, s.MaxConnections
+		}
+	}
+
+	return "", 0
+}
+
+// abortStream answer a stream request which failed to open its upstream.
+func abortStream(ctx *gin.Context, err error) {
+	var maxErr *maxConnectionsError
+	if errors.As(err, &maxErr) {
+		abortXtream(ctx, http.StatusServiceUnavailable, "Max Connections Reached", "Maximum number of connections reached, try again later", err)
+		return
+	}
+
+	ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+}
+
+// abortXtream abort the request with an error in the format of the Xtream login response.
+func abortXtream(ctx *gin.Context, code int, status, message string, err error) {
+	ctx.Error(err) // nolint: errcheck
+	ctx.AbortWithStatusJSON(code, gin.H{
+		"user_info": gin.H{
+			"auth":    0,
+			"status":  status,
+			"message": message,
+		},
+	})
+}
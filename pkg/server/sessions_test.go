@@ -0,0 +1,299 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
+)
+
+// cancelable return a session and the context canceled when it is stopped.
+func cancelable(account string, priority int) (*session, context.Context) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &session{account: account, priority: priority, bytes: new(int64), cancel: cancel}, ctx
+}
+
+func newTestSession(account string, priority int) *session {
+	s, _ := cancelable(account, priority)
+	return s
+}
+
+func TestSessionsReject(t *testing.T) {
+	r := newSessionRegistry()
+
+	first := newTestSession("a", 0)
+	if err := r.acquire(nil, first, 1, connectionsReject, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var maxErr *maxConnectionsError
+	if err := r.acquire(nil, newTestSession("a", 0), 1, connectionsReject, 0); !errors.As(err, &maxErr) {
+		t.Errorf("acquire() over the limit = %v, want a max connections error", err)
+	}
+	// the default policy rejects
+	if err := r.acquire(nil, newTestSession("a", 0), 1, "", 0); !errors.As(err, &maxErr) {
+		t.Errorf("acquire() with the default policy = %v, want a max connections error", err)
+	}
+
+	// other accounts, unknown accounts and unlimited accounts are not limited
+	for _, s := range []struct {
+		account string
+		max     int
+	}{{"b", 1}, {"", 1}, {"a", 0}} {
+		if err := r.acquire(nil, newTestSession(s.account, 0), s.max, connectionsReject, 0); err != nil {
+			t.Errorf("acquire(%q, max %d) = %v", s.account, s.max, err)
+		}
+	}
+
+	r.release(first)
+	r.release(first)
+	if n := r.connections("a"); n != 1 {
+		t.Errorf("connections(a) = %d after a release, want 1", n)
+	}
+	if err := r.acquire(nil, newTestSession("a", 0), 2, connectionsReject, 0); err != nil {
+		t.Errorf("acquire() after a release = %v", err)
+	}
+}
+
+func TestSessionsQueue(t *testing.T) {
+	r := newSessionRegistry()
+
+	first := newTestSession("a", 0)
+	if err := r.acquire(nil, first, 1, connectionsQueue, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	var released int32
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&released, 1)
+		r.release(first)
+	}()
+
+	queued := newTestSession("a", 0)
+	if err := r.acquire(nil, queued, 1, connectionsQueue, time.Second); err != nil {
+		t.Fatalf("acquire() queued = %v", err)
+	}
+	if atomic.LoadInt32(&released) == 0 {
+		t.Error("acquire() queued returned before a connection was released")
+	}
+
+	// the queue timeout rejects
+	var maxErr *maxConnectionsError
+	start := time.Now()
+	if err := r.acquire(nil, newTestSession("a", 0), 1, connectionsQueue, 50*time.Millisecond); !errors.As(err, &maxErr) {
+		t.Errorf("acquire() after the queue timeout = %v, want a max connections error", err)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("acquire() rejected after %s, before the queue timeout", d)
+	}
+
+	// the client leaving stops the wait
+	done := make(chan struct{})
+	close(done)
+	if err := r.acquire(done, newTestSession("a", 0), 1, connectionsQueue, time.Second); !errors.Is(err, context.Canceled) {
+		t.Errorf("acquire() of a client gone = %v, want %v", err, context.Canceled)
+	}
+
+	if n := r.connections("a"); n != 1 {
+		t.Errorf("connections(a) = %d, want 1", n)
+	}
+}
+
+func TestSessionsPreempt(t *testing.T) {
+	tests := []struct {
+		name     string
+		running  []int
+		priority int
+		// index of the running session preempted, -1 when the new one is rejected
+		want int
+	}{
+		{"oldest of the same priority", []int{0, 0}, 0, 0},
+		{"lowest priority first", []int{5, 1, 5}, 5, 1},
+		{"lower priority", []int{1, 1}, 3, 0},
+		{"only higher priorities", []int{5, 3}, 1, -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newSessionRegistry()
+
+			running := make([]context.Context, len(tt.running))
+			for i, priority := range tt.running {
+				var s *session
+				s, running[i] = cancelable("a", priority)
+				if err := r.acquire(nil, s, len(tt.running), connectionsPreempt, 0); err != nil {
+					t.Fatal(err)
+				}
+				// distinct start times
+				time.Sleep(time.Millisecond)
+			}
+			// another account is never preempted
+			other, otherCtx := cancelable("b", -1)
+			if err := r.acquire(nil, other, 1, connectionsPreempt, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			err := r.acquire(nil, newTestSession("a", tt.priority), len(tt.running), connectionsPreempt, 0)
+			if tt.want < 0 {
+				var maxErr *maxConnectionsError
+				if !errors.As(err, &maxErr) {
+					t.Errorf("acquire() = %v, want a max connections error", err)
+				}
+			} else if err != nil {
+				t.Fatalf("acquire() = %v", err)
+			}
+
+			for i, ctx := range running {
+				if preempted := ctx.Err() != nil; preempted != (i == tt.want) {
+					t.Errorf("session %d preempted = %v, want %v", i, preempted, i == tt.want)
+				}
+			}
+			if otherCtx.Err() != nil {
+				t.Error("session of another account preempted")
+			}
+			if n := r.connections("a"); n != len(tt.running) {
+				t.Errorf("connections(a) = %d, want %d", n, len(tt.running))
+			}
+		})
+	}
+}
+
+func TestOpenSessionUserPriority(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	c := &Config{
+		ProxyConfig: &config.ProxyConfig{Connections: config.ConnectionLimits{Policy: connectionsPreempt}},
+		sessions:    newSessionRegistry(),
+		tracks:      newTrackIndex(),
+		xtreamProviders: newXtreamProviders([]config.XtreamProvider{
+			{BaseURL: "http://provider.example.com", User: "u", Password: "p", MaxConnections: 1},
+		}),
+	}
+	u, err := url.Parse("http://provider.example.com/u/p/1.ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open := func(user *users.User) (*session, context.Context, error) {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		if user != nil {
+			ctx.Set(userKey, user)
+		}
+		return c.openSession(ctx, u)
+	}
+
+	vip, vipCtx, err := open(&users.User{Name: "vip", Priority: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vip.user != "vip" || vip.priority != 10 || vip.account != "xtream http://provider.example.com" {
+		t.Errorf("session = %s/%d/%s, want vip/10/xtream http://provider.example.com", vip.user, vip.priority, vip.account)
+	}
+
+	// the unauthenticated requests have the lowest priority
+	if _, _, err := open(nil); err == nil {
+		t.Error("openSession() without user preempted a priority 10 user")
+	}
+	if _, _, err := open(&users.User{Name: "bob", Priority: 1}); err == nil {
+		t.Error("openSession() of a priority 1 user preempted a priority 10 user")
+	}
+	if vipCtx.Err() != nil {
+		t.Fatal("priority 10 session preempted")
+	}
+
+	if _, _, err := open(&users.User{Name: "boss", Priority: 10}); err != nil {
+		t.Errorf("openSession() of an equal priority = %v, want the oldest preempted", err)
+	}
+	if vipCtx.Err() == nil {
+		t.Error("oldest session of the same priority not preempted")
+	}
+}
+
+func TestProviderMaxConnections(t *testing.T) {
+	var (
+		logins int32
+		fail   int32 = 1
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&logins, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, `{"user_info":{"username":"u","password":"p","auth":1,"status":"Active","max_connections":"2"},"server_info":{}}`) // nolint: errcheck
+	}))
+	defer srv.Close()
+
+	p := newXtreamProviders([]config.XtreamProvider{{BaseURL: srv.URL, User: "u", Password: "p"}})[0]
+
+	// no limit until the login succeeds, and no new login before the backoff
+	for i := 0; i < 3; i++ {
+		if n := p.maxConnections(); n != 0 {
+			t.Errorf("maxConnections() after a failed login = %d, want 0", n)
+		}
+	}
+	if n := atomic.LoadInt32(&logins); n != 1 {
+		t.Errorf("%d logins during the backoff, want 1", n)
+	}
+	if p.limitBackoff != minLimitBackoff {
+		t.Errorf("backoff = %s, want %s", p.limitBackoff, minLimitBackoff)
+	}
+
+	// the backoff doubles after each failure
+	p.limitRetry = time.Time{}
+	p.maxConnections()
+	if p.limitBackoff != 2*minLimitBackoff {
+		t.Errorf("backoff = %s, want %s", p.limitBackoff, 2*minLimitBackoff)
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	p.limitRetry = time.Time{}
+	for i := 0; i < 3; i++ {
+		if n := p.maxConnections(); n != 2 {
+			t.Errorf("maxConnections() = %d, want 2", n)
+		}
+	}
+	if n := atomic.LoadInt32(&logins); n != 3 {
+		t.Errorf("%d logins, want 3: the limit is fetched once", n)
+	}
+
+	// the configured limit is used as is
+	for _, tt := range []struct{ configured, want int }{{5, 5}, {-1, 0}} {
+		p := newXtreamProviders([]config.XtreamProvider{{BaseURL: srv.URL, MaxConnections: tt.configured}})[0]
+		if n := p.maxConnections(); n != tt.want {
+			t.Errorf("maxConnections() configured %d = %d, want %d", tt.configured, n, tt.want)
+		}
+	}
+	if n := atomic.LoadInt32(&logins); n != 3 {
+		t.Errorf("%d logins, want none for the configured limits", n)
+	}
+}
@@ -0,0 +1,305 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+)
+
+// Environment of a process started by a graceful restart.
+const (
+	// number of listening sockets inherited, from the file descriptor 3 in the servers order
+	listenerFDsEnv = "IPTV_PROXY_LISTENER_FDS"
+	parentPIDEnv   = "IPTV_PROXY_PARENT_PID"
+)
+
+// listen return the sockets inherited from the previous process on a graceful restart,
+// or open new ones on the servers addresses.
+func listen(servers []*http.Server) ([]net.Listener, bool, error) {
+	listeners := make([]net.Listener, 0, len(servers))
+
+	fds := os.Getenv(listenerFDsEnv)
+	if fds == "" {
+		for _, srv := range servers {
+			ln, err := net.Listen("tcp", srv.Addr)
+			if err != nil {
+				closeListeners(listeners)
+				return nil, false, err
+			}
+			listeners = append(listeners, ln)
+		}
+		return listeners, false, nil
+	}
+	os.Unsetenv(listenerFDsEnv) // nolint: errcheck
+
+	if n, err := strconv.Atoi(fds); err != nil || n != len(servers) {
+		return nil, false, fmt.Errorf("%s: %q inherited listeners for %d servers", listenerFDsEnv, fds, len(servers))
+	}
+
+	for i := range servers {
+		f := os.NewFile(uintptr(3+i), "listener")
+		ln, err := net.FileListener(f)
+		f.Close() // nolint: errcheck
+		if err != nil {
+			closeListeners(listeners)
+			return nil, false, fmt.Errorf("inherited listener: %v", err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	return listeners, true, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, ln := range listeners {
+		ln.Close() // nolint: errcheck
+	}
+}
+
+// handoff start a new process of the current binary sharing the listening sockets,
+// the new process ask this one to shut down once it serves the requests.
+func handoff(listeners []net.Listener) error {
+	files := make([]*os.File, 0, len(listeners))
+	defer func() {
+		for _, f := range files {
+			f.Close() // nolint: errcheck
+		}
+	}()
+	for _, ln := range listeners {
+		tcp, ok := ln.(*net.TCPListener)
+		if !ok {
+			return errors.New("listener can't be handed off")
+		}
+		f, err := tcp.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	// the path of the binary on disk, which may have been replaced by a new version
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", listenerFDsEnv, len(files)),
+		fmt.Sprintf("%s=%d", parentPIDEnv, os.Getpid()),
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	logger.Info("new process started", "pid", cmd.Process.Pid)
+
+	go func() {
+		if err := cmd.Wait(); err != nil {
+			logger.Error("new process", "pid", cmd.Process.Pid, "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// notifyParent ask the process which handed off the listener to shut down.
+func notifyParent() {
+	pid, err := strconv.Atoi(os.Getenv(parentPIDEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(parentPIDEnv) // nolint: errcheck
+
+	if pid != os.Getppid() {
+		return
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		logger.Warn("previous process", "pid", pid, "error", err)
+	}
+}
+
+// serve the requests until a termination signal, then shut down gracefully.
+// The servers with a TLS configuration serve https.
+func (c *Config) serve(servers []*http.Server) error {
+	listeners, inherited, err := listen(servers)
+	if err != nil {
+		return err
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	if c.GracefulRestart {
+		if restartSignal == nil {
+			closeListeners(listeners)
+			return errors.New("graceful restart isn't supported on this platform")
+		}
+		signal.Notify(signals, restartSignal)
+	}
+	defer signal.Stop(signals)
+
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		// the server is modified once serving, it is only read before
+		useTLS := srv.TLSConfig != nil
+		logger.Info("listening", "address", listeners[i].Addr().String(), "tls", useTLS, "inherited", inherited)
+
+		go func(srv *http.Server, ln net.Listener) {
+			if useTLS {
+				errs <- srv.ServeTLS(ln, "", "")
+				return
+			}
+			errs <- srv.Serve(ln)
+		}(srv, listeners[i])
+	}
+
+	atomic.StoreInt32(c.ready, 1)
+	if inherited {
+		notifyParent()
+	}
+
+	for {
+		select {
+		case err := <-errs:
+			c.shutdown(servers, nil) // nolint: errcheck
+			return err
+		case sig := <-signals:
+			if sig == restartSignal {
+				if err := handoff(listeners); err != nil {
+					logger.Error("graceful restart", "error", err)
+				}
+				// this process is drained when the new one is ready
+				continue
+			}
+			logger.Info("signal received", "signal", sig.String())
+			return c.shutdown(servers, signals)
+		}
+	}
+}
+
+// shutdown stop accepting connections and let the streams in progress end
+// during the grace period, a signal cuts them immediately.
+func (c *Config) shutdown(servers []*http.Server, signals <-chan os.Signal) error {
+	defer removeTempFiles()
+	// after the streams ended, with their last bytes
+	defer c.saveUsage()
+
+	atomic.StoreInt32(c.ready, 0)
+
+	grace := time.Duration(c.ShutdownGrace) * time.Second
+	logger.Info("shutting down", "streams", len(c.sessions.list()), "grace", grace.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			errs <- srv.Shutdown(ctx)
+		}(srv)
+	}
+	drained := true
+	for range servers {
+		if err := <-errs; err != nil {
+			drained = false
+		}
+	}
+	if drained {
+		logger.Info("shutdown complete")
+		return nil
+	}
+
+	logger.Warn("cutting the remaining streams", "streams", c.sessions.killAll())
+	var err error
+	for _, srv := range servers {
+		if e := srv.Close(); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+// tempFiles are the temporary files in use, removed on shutdown if still there.
+var tempFiles = struct {
+	sync.Mutex
+	names map[string]struct{}
+}{names: map[string]struct{}{}}
+
+// createTemp create a temporary file to be released with removeTemp.
+func createTemp(pattern string) (*os.File, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	tempFiles.Lock()
+	tempFiles.names[f.Name()] = struct{}{}
+	tempFiles.Unlock()
+
+	return f, nil
+}
+
+func removeTemp(f *os.File) {
+	f.Close()           // nolint: errcheck
+	os.Remove(f.Name()) // nolint: errcheck
+
+	tempFiles.Lock()
+	delete(tempFiles.names, f.Name())
+	tempFiles.Unlock()
+}
+
+func removeTempFiles() {
+	tempFiles.Lock()
+	defer tempFiles.Unlock()
+
+	for name := range tempFiles.names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			logger.Warn("temporary file", "file", name, "error", err)
+		}
+		delete(tempFiles.names, name)
+	}
+}
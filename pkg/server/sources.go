@@ -0,0 +1,151 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// sourceTagName is the tag added to each track with the name of its source.
+const sourceTagName = "source"
+
+// m3uSource is an upstream playlist merged into the proxyfied playlist.
+type m3uSource struct {
+	config.M3USource
+
+	sync.RWMutex
+	tracks      []m3u.Track
+	hosts       map[string]bool
+	lastRefresh time.Time
+	lastErr     error
+}
+
+func newM3USource(s config.M3USource) *m3uSource {
+	return &m3uSource{M3USource: s}
+}
+
+// refresh fetch and parse the source playlist.
+// On error the previously fetched tracks are kept.
+func (s *m3uSource) refresh() error {
+	p, err := s.parse()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.lastErr = err
+	sourceRefreshes.WithLabelValues(s.Name, resultLabel(err)).Inc()
+	if err != nil {
+		return err
+	}
+
+	if s.Name != "" {
+		for i := range p.Tracks {
+			p.Tracks[i].Tags = append(p.Tracks[i].Tags, m3u.Tag{Name: sourceTagName, Value: s.Name})
+		}
+	}
+	s.tracks = p.Tracks
+	s.hosts = map[string]bool{}
+	for _, track := range p.Tracks {
+		if u, err := url.Parse(track.URI); err == nil {
+			s.hosts[u.Host] = true
+		}
+	}
+	s.lastRefresh = time.Now()
+
+	return nil
+}
+
+func (s *m3uSource) parse() (m3u.Playlist, error) {
+	if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+		return m3u.Parse(s.URL)
+	}
+
+	if s.User == "" && s.Password == "" {
+		return m3u.Parse(s.URL)
+	}
+
+	// m3u.Parse doesn't support authentication,
+	// download the playlist into a temporary file first.
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		return m3u.Playlist{}, err
+	}
+	req.SetBasicAuth(s.User.String(), s.Password.String())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return m3u.Playlist{}, fmt.Errorf("unable to open playlist URL: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return m3u.Playlist{}, fmt.Errorf("unable to open playlist URL: status code %d", resp.StatusCode)
+	}
+
+	f, err := createTemp("*.iptv-proxy-source.m3u")
+	if err != nil {
+		return m3u.Playlist{}, err
+	}
+	defer removeTemp(f)
+
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		return m3u.Playlist{}, err
+	}
+
+	return m3u.Parse(f.Name())
+}
+
+// hasHost tell if some tracks of the source are streamed from host.
+func (s *m3uSource) hasHost(host string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.hosts[host]
+}
+
+func (s *m3uSource) getTracks() []m3u.Track {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.tracks
+}
+
+// mergeSources concatenate the sources tracks in the configuration order.
+func mergeSources(sources []*m3uSource) *m3u.Playlist {
+	var n int
+	for _, s := range sources {
+		n += len(s.getTracks())
+	}
+
+	p := &m3u.Playlist{Tracks: make([]m3u.Track, 0, n)}
+	for _, s := range sources {
+		p.Tracks = append(p.Tracks, s.getTracks()...)
+	}
+
+	return p
+}
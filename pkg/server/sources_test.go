@@ -0,0 +1,164 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func writePlaylist(t *testing.T, path string, names ...string) {
+	t.Helper()
+
+	content := "#EXTM3U\n"
+	for _, name := range names {
+		content += "#EXTINF:-1 tvg-id=\"" + name + "\"," + name + "\nhttp://example.com/" + name + ".ts\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func trackNames(tracks []m3u.Track) []string {
+	names := make([]string, 0, len(tracks))
+	for _, track := range tracks {
+		names = append(names, track.Name)
+	}
+
+	return names
+}
+
+func TestMergeSources(t *testing.T) {
+	dir := t.TempDir()
+	writePlaylist(t, filepath.Join(dir, "a.m3u"), "a1", "a2")
+	writePlaylist(t, filepath.Join(dir, "b.m3u"), "b1")
+
+	a := newM3USource(config.M3USource{Name: "a", URL: filepath.Join(dir, "a.m3u")})
+	b := newM3USource(config.M3USource{URL: filepath.Join(dir, "b.m3u")})
+	failing := newM3USource(config.M3USource{Name: "failing", URL: filepath.Join(dir, "missing.m3u")})
+	for _, s := range []*m3uSource{a, b} {
+		if err := s.refresh(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := failing.refresh(); err == nil {
+		t.Error("refresh() of a missing playlist, want an error")
+	}
+
+	p := mergeSources([]*m3uSource{b, failing, a})
+	if got, want := trackNames(p.Tracks), []string{"b1", "a1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mergeSources() = %v, want %v", got, want)
+	}
+
+	// the tracks of a named source are tagged with its name
+	want := map[string]string{"b1": "", "a1": "a", "a2": "a"}
+	for _, track := range p.Tracks {
+		var source string
+		for _, tag := range track.Tags {
+			if tag.Name == sourceTagName {
+				source = tag.Value
+			}
+		}
+		if source != want[track.Name] {
+			t.Errorf("%s source tag = %q, want %q", track.Name, source, want[track.Name])
+		}
+	}
+}
+
+func TestM3USourceRefreshKeepsTracks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.m3u")
+	writePlaylist(t, path, "a1", "a2")
+
+	s := newM3USource(config.M3USource{Name: "a", URL: path})
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	writePlaylist(t, path, "a3")
+	if err := s.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := trackNames(s.getTracks()), []string{"a3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tracks after a refresh = %v, want %v", got, want)
+	}
+
+	// a failed refresh keeps the previous tracks
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.refresh(); err == nil {
+		t.Error("refresh() of a removed playlist, want an error")
+	}
+	if got, want := trackNames(s.getTracks()), []string{"a3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tracks after a failed refresh = %v, want %v", got, want)
+	}
+}
+
+func TestM3USourceBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "u" || password != "p" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("#EXTM3U\n#EXTINF:-1,a1\nhttp://example.com/a1.ts\n")) // nolint: errcheck
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		wantErr  bool
+	}{
+		{"credentials", "u", "p", false},
+		{"wrong password", "u", "x", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newM3USource(config.M3USource{
+				URL:      srv.URL + "/playlist.m3u",
+				User:     config.CredentialString(tt.user),
+				Password: config.CredentialString(tt.password),
+			})
+
+			err := s.refresh()
+			if tt.wantErr {
+				if err == nil {
+					t.Error("refresh(), want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := trackNames(s.getTracks()), []string{"a1"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("tracks = %v, want %v", got, want)
+			}
+		})
+	}
+}
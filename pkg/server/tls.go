@@ -0,0 +1,131 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/tls"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+)
+
+// certReloadDelay gathers the events of a certificate renewal into a single reload.
+const certReloadDelay = time.Second
+
+// certReloader serve a TLS certificate, reloaded when its files change or on SIGHUP.
+// The connections established keep the certificate of their handshake.
+type certReloader struct {
+	sync.RWMutex
+	certFile, keyFile string
+	cert              *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.Lock()
+	r.cert = &cert
+	r.Unlock()
+
+	return nil
+}
+
+// reload keep the current certificate when the new one is invalid.
+func (r *certReloader) reload(reason string) {
+	if err := r.load(); err != nil {
+		logger.Error("tls certificate reload", "reason", reason, "error", err)
+		return
+	}
+	logger.Info("tls certificate reloaded", "reason", reason, "file", r.certFile)
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.cert, nil
+}
+
+// watch reload the certificate until done is closed.
+// The directories are watched rather than the files, which are often replaced by a rename
+// or a symlink update on renewal.
+func (r *certReloader) watch(done <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var events chan fsnotify.Event
+	var errs chan error
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		defer watcher.Close()
+		for _, dir := range []string{filepath.Dir(r.certFile), filepath.Dir(r.keyFile)} {
+			if err = watcher.Add(dir); err != nil {
+				break
+			}
+		}
+		events, errs = watcher.Events, watcher.Errors
+	}
+	if err != nil {
+		logger.Warn("tls certificate files not watched, reload it with SIGHUP", "error", err)
+	}
+
+	files := map[string]bool{
+		filepath.Clean(r.certFile): true,
+		filepath.Clean(r.keyFile):  true,
+	}
+
+	var delay <-chan time.Time
+	for {
+		select {
+		case <-done:
+			return
+		case <-hup:
+			r.reload("SIGHUP")
+		case event := <-events:
+			// a symlink swap, as for the kubernetes secrets, only shows the parent entries changes
+			if files[filepath.Clean(event.Name)] || event.Op&fsnotify.Create != 0 {
+				delay = time.After(certReloadDelay)
+			}
+		case err := <-errs:
+			logger.Warn("tls certificate watch", "error", err)
+		case <-delay:
+			delay = nil
+			r.reload("files changed")
+		}
+	}
+}
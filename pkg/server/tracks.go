@@ -0,0 +1,293 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamesnetherton/m3u"
+)
+
+// trackIndex is the lookup table of the tracks served by the m3u endpoints.
+// It is safe for concurrent use and can be replaced while serving.
+type trackIndex struct {
+	sync.RWMutex
+	tracks map[string]indexedTrack
+	// ids of the tracks in the playlist order
+	ids []string
+}
+
+// indexedTrack is a track served by the m3u endpoints.
+type indexedTrack struct {
+	m3u.Track
+	// alternates URIs of the same channel, tried in order when the track URI fails
+	alternates []string
+}
+
+func newTrackIndex() *trackIndex {
+	return &trackIndex{tracks: map[string]indexedTrack{}}
+}
+
+// replace the whole track set, ids[i] being the identifier of tracks[i]
+// and alternates the fallback URIs of the tracks by identifier.
+func (t *trackIndex) replace(tracks []m3u.Track, ids []string, alternates map[string][]string) {
+	index := make(map[string]indexedTrack, len(tracks))
+	for i := range tracks {
+		index[ids[i]] = indexedTrack{Track: tracks[i], alternates: alternates[ids[i]]}
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	t.tracks = index
+	t.ids = ids
+}
+
+// lookup return a copy of the track identified by id.
+func (t *trackIndex) lookup(id string) (indexedTrack, bool) {
+	t.RLock()
+	defer t.RUnlock()
+
+	track, ok := t.tracks[id]
+
+	return track, ok
+}
+
+// snapshot return the tracks in the playlist order with their identifiers.
+func (t *trackIndex) snapshot() ([]m3u.Track, []string) {
+	t.RLock()
+	defer t.RUnlock()
+
+	tracks := make([]m3u.Track, 0, len(t.ids))
+	for _, id := range t.ids {
+		tracks = append(tracks, t.tracks[id].Track)
+	}
+
+	return tracks, t.ids
+}
+
+func (t *trackIndex) len() int {
+	t.RLock()
+	defer t.RUnlock()
+
+	return len(t.tracks)
+}
+
+// trackIDRetention is how long an identifier is kept once its track
+// disappeared from the playlist, in case the provider brings it back.
+const trackIDRetention = 30 * 24 * time.Hour
+
+type trackIDEntry struct {
+	Key      string    `json:"key"`
+	URI      string    `json:"uri"`
+	Name     string    `json:"name"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// trackIDStore assign stable identifiers to tracks.
+// Identifiers are derived from the track attributes and the mapping
+// is persisted in path (if not empty) to survive restarts.
+type trackIDStore struct {
+	sync.Mutex
+	path string
+
+	Endpoint string                  `json:"endpoint,omitempty"`
+	Tracks   map[string]trackIDEntry `json:"tracks"`
+}
+
+func loadTrackIDStore(path string) (*trackIDStore, error) {
+	s := &trackIDStore{path: path, Tracks: map[string]trackIDEntry{}}
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("track ids file %q: %w", path, err)
+	}
+	if s.Tracks == nil {
+		s.Tracks = map[string]trackIDEntry{}
+	}
+
+	return s, nil
+}
+
+// trackKey return the most stable attribute identifying a track:
+// its tvg-id, its name and group or its original URI.
+func trackKey(track *m3u.Track) string {
+	var tvgID, group string
+	for _, tag := range track.Tags {
+		switch tag.Name {
+		case "tvg-id", "tvg-ID":
+			tvgID = tag.Value
+		case "group-title":
+			group = tag.Value
+		}
+	}
+
+	switch {
+	case tvgID != "":
+		return "tvg-id:" + tvgID
+	case track.Name != "":
+		return "name:" + track.Name + "|" + group
+	default:
+		return "uri:" + track.URI
+	}
+}
+
+// assign return the identifier of each track.
+// Tracks sharing the same key (e.g. several qualities of a channel with the same tvg-id)
+// keep the identifier previously given to the same URI, or to the same name.
+func (s *trackIDStore) assign(tracks []m3u.Track) ([]string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+
+	byKey := map[string][]string{}
+	for id, e := range s.Tracks {
+		byKey[e.Key] = append(byKey[e.Key], id)
+	}
+	for k := range byKey {
+		sort.Strings(byKey[k])
+	}
+
+	used := make(map[string]bool, len(tracks))
+	ids := make([]string, len(tracks))
+
+	// First pass on exact URI matches, so that a new track inserted
+	// before an existing one with the same key can't steal its identifier.
+	for i := range tracks {
+		key := trackKey(&tracks[i])
+		for _, id := range byKey[key] {
+			if !used[id] && s.Tracks[id].URI == tracks[i].URI {
+				ids[i] = id
+				used[id] = true
+				break
+			}
+		}
+	}
+
+	for i := range tracks {
+		if ids[i] != "" {
+			continue
+		}
+
+		key := trackKey(&tracks[i])
+		for _, id := range byKey[key] {
+			if !used[id] && s.Tracks[id].Name == tracks[i].Name {
+				ids[i] = id
+				break
+			}
+		}
+		if ids[i] == "" {
+			for _, id := range byKey[key] {
+				if !used[id] {
+					ids[i] = id
+					break
+				}
+			}
+		}
+		if ids[i] == "" {
+			ids[i] = s.newID(key, used)
+		}
+		used[ids[i]] = true
+	}
+
+	for i, id := range ids {
+		s.Tracks[id] = trackIDEntry{
+			Key:      trackKey(&tracks[i]),
+			URI:      tracks[i].URI,
+			Name:     tracks[i].Name,
+			LastSeen: now,
+		}
+	}
+
+	for id, e := range s.Tracks {
+		if now.Sub(e.LastSeen) > trackIDRetention {
+			delete(s.Tracks, id)
+		}
+	}
+
+	return ids, s.save()
+}
+
+func (s *trackIDStore) newID(key string, used map[string]bool) string {
+	sum := sha1.Sum([]byte(key))
+	base := hex.EncodeToString(sum[:])[:10]
+
+	id := base
+	for n := 2; ; n++ {
+		if _, ok := s.Tracks[id]; !ok && !used[id] {
+			return id
+		}
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+// setEndpoint record the anti-collision endpoint, returning the one previously persisted if any.
+func (s *trackIDStore) setEndpoint(endpoint string) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.Endpoint != "" {
+		return s.Endpoint, nil
+	}
+	s.Endpoint = endpoint
+
+	return endpoint, s.save()
+}
+
+func (s *trackIDStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	}
+
+	tmpPath := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, s.path)
+}
@@ -0,0 +1,251 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jamesnetherton/m3u"
+)
+
+func idTrack(name, uri string, tags ...string) m3u.Track {
+	track := m3u.Track{Name: name, URI: uri, Length: -1}
+	for i := 0; i+1 < len(tags); i += 2 {
+		track.Tags = append(track.Tags, m3u.Tag{Name: tags[i], Value: tags[i+1]})
+	}
+
+	return track
+}
+
+func TestTrackIndexLookup(t *testing.T) {
+	index := newTrackIndex()
+	index.replace([]m3u.Track{
+		idTrack("CNN", "http://example.com/cnn.ts"),
+		idTrack("BBC One", "http://example.com/bbc1.ts"),
+	}, []string{"a1", "b2"}, nil)
+
+	tests := []struct {
+		id   string
+		want string
+		ok   bool
+	}{
+		{"a1", "CNN", true},
+		{"b2", "BBC One", true},
+		{"0", "", false},
+		{"c3", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			track, ok := index.lookup(tt.id)
+			if ok != tt.ok || track.Name != tt.want {
+				t.Errorf("lookup(%q) = %q, %v, want %q, %v", tt.id, track.Name, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestTrackIndexReplace(t *testing.T) {
+	index := newTrackIndex()
+	index.replace([]m3u.Track{idTrack("CNN", "http://example.com/cnn.ts")}, []string{"a1"}, nil)
+
+	// a request running keeps the track it looked up
+	running, _ := index.lookup("a1")
+
+	index.replace([]m3u.Track{
+		idTrack("BBC One", "http://example.com/bbc1.ts"),
+		idTrack("BBC Two", "http://example.com/bbc2.ts"),
+	}, []string{"b2", "c3"}, map[string][]string{"b2": {"http://backup.example.com/bbc1.ts"}})
+
+	if running.Name != "CNN" {
+		t.Errorf("running track = %q, want CNN", running.Name)
+	}
+	if _, ok := index.lookup("a1"); ok {
+		t.Error("lookup(a1) found a removed track")
+	}
+	track, _ := index.lookup("b2")
+	if track.Name != "BBC One" {
+		t.Errorf("lookup(b2) = %q, want BBC One", track.Name)
+	}
+	if want := []string{"http://backup.example.com/bbc1.ts"}; !reflect.DeepEqual(track.alternates, want) {
+		t.Errorf("lookup(b2) alternates = %v, want %v", track.alternates, want)
+	}
+	if track, _ := index.lookup("c3"); len(track.alternates) != 0 {
+		t.Errorf("lookup(c3) alternates = %v, want none", track.alternates)
+	}
+	if n := index.len(); n != 2 {
+		t.Errorf("len() = %d, want 2", n)
+	}
+}
+
+func TestTrackKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		track m3u.Track
+		want  string
+	}{
+		{"tvg-id", idTrack("CNN", "http://example.com/1.ts", "tvg-id", "cnn.us", "group-title", "News"), "tvg-id:cnn.us"},
+		{"tvg-ID", idTrack("CNN", "http://example.com/1.ts", "tvg-ID", "cnn.us"), "tvg-id:cnn.us"},
+		{"name and group", idTrack("CNN", "http://example.com/1.ts", "group-title", "News"), "name:CNN|News"},
+		{"name", idTrack("CNN", "http://example.com/1.ts"), "name:CNN|"},
+		{"uri", idTrack("", "http://example.com/1.ts"), "uri:http://example.com/1.ts"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := trackKey(&tt.track); got != tt.want {
+				t.Errorf("trackKey() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackIDStoreAssign(t *testing.T) {
+	cnn := idTrack("CNN", "http://example.com/1.ts", "tvg-id", "cnn.us")
+	bbcHD := idTrack("BBC One HD", "http://example.com/2.ts", "tvg-id", "bbc1.uk")
+	bbcSD := idTrack("BBC One SD", "http://example.com/3.ts", "tvg-id", "bbc1.uk")
+	kids := idTrack("Cartoon", "http://example.com/4.ts", "group-title", "Kids")
+
+	s, err := loadTrackIDStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.assign([]m3u.Track{cnn, bbcHD, bbcSD, kids})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]string{}
+	for i, name := range []string{"CNN", "BBC One HD", "BBC One SD", "Cartoon"} {
+		if _, ok := ids[first[i]]; ok {
+			t.Fatalf("assign() = %v, duplicated id %q", first, first[i])
+		}
+		ids[first[i]] = name
+	}
+	id := func(name string) string {
+		for k, v := range ids {
+			if v == name {
+				return k
+			}
+		}
+		return ""
+	}
+
+	moved := cnn
+	moved.URI = "http://example.com/new-token/1.ts"
+	bbcFHD := idTrack("BBC One FHD", "http://example.com/5.ts", "tvg-id", "bbc1.uk")
+
+	tests := []struct {
+		name   string
+		tracks []m3u.Track
+		want   []string
+	}{
+		{"same playlist", []m3u.Track{cnn, bbcHD, bbcSD, kids}, []string{id("CNN"), id("BBC One HD"), id("BBC One SD"), id("Cartoon")}},
+		{"reordered", []m3u.Track{kids, bbcSD, cnn, bbcHD}, []string{id("Cartoon"), id("BBC One SD"), id("CNN"), id("BBC One HD")}},
+		{"new url", []m3u.Track{moved, bbcHD, bbcSD, kids}, []string{id("CNN"), id("BBC One HD"), id("BBC One SD"), id("Cartoon")}},
+		{"variant inserted before", []m3u.Track{cnn, bbcFHD, bbcHD, bbcSD, kids}, []string{id("CNN"), "", id("BBC One HD"), id("BBC One SD"), id("Cartoon")}},
+		{"others removed", []m3u.Track{cnn}, []string{id("CNN")}},
+		{"back", []m3u.Track{cnn, bbcHD, bbcSD, kids}, []string{id("CNN"), id("BBC One HD"), id("BBC One SD"), id("Cartoon")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.assign(tt.tracks)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := range tt.want {
+				if tt.want[i] == "" {
+					// a new track gets a new id
+					if _, ok := ids[got[i]]; ok {
+						t.Errorf("assign() %s = %q, the id of %s", tt.tracks[i].Name, got[i], ids[got[i]])
+					}
+					tt.want[i] = got[i]
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("assign() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackIDStoreRetention(t *testing.T) {
+	s, err := loadTrackIDStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracks := []m3u.Track{idTrack("CNN", "http://example.com/1.ts", "tvg-id", "cnn.us")}
+	ids, err := s.assign(tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := s.Tracks[ids[0]]
+	e.LastSeen = time.Now().Add(-trackIDRetention - time.Hour)
+	s.Tracks[ids[0]] = e
+
+	if _, err := s.assign(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Tracks[ids[0]]; ok {
+		t.Errorf("id %q kept after %s", ids[0], trackIDRetention)
+	}
+}
+
+func TestTrackIDStorePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids", "tracks.json")
+	tracks := []m3u.Track{
+		idTrack("CNN", "http://example.com/1.ts", "tvg-id", "cnn.us"),
+		idTrack("Cartoon", "http://example.com/4.ts", "group-title", "Kids"),
+	}
+
+	s, err := loadTrackIDStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, err := s.assign(tracks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint, err := s.setEndpoint("abcd"); err != nil || endpoint != "abcd" {
+		t.Fatalf("setEndpoint() = %q, %v, want abcd", endpoint, err)
+	}
+
+	// after a restart
+	s, err = loadTrackIDStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if endpoint, err := s.setEndpoint("efgh"); err != nil || endpoint != "abcd" {
+		t.Errorf("setEndpoint() = %q, %v, want the persisted abcd", endpoint, err)
+	}
+	// the tracks come back in another order
+	got, err := s.assign([]m3u.Track{tracks[1], tracks[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{ids[1], ids[0]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("assign() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Dashboard of the iptv-proxy admin API, served under <endpoint>/admin/ui/.
+'use strict';
+
+const api = '../api';
+
+let channels = [];
+let group = null;
+let previous = {};
+
+async function request(method, path, body) {
+  const resp = await fetch(api + path, {
+    method: method,
+    // the admin API only accepts JSON changes
+    headers: method === 'GET' ? {} : {'Content-Type': 'application/json'},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  if (!resp.ok) {
+    throw new Error(method + ' ' + path + ': ' + resp.status);
+  }
+  return resp.status === 204 ? null : resp.json();
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  Object.entries(attrs || {}).forEach(([k, v]) => {
+    if (k.startsWith('on')) {
+      e.addEventListener(k.slice(2), v);
+    } else {
+      e.setAttribute(k, v);
+    }
+  });
+  children.forEach((c) => e.append(c));
+  return e;
+}
+
+function size(bytes) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let i = 0;
+  while (bytes >= 1024 && i < units.length - 1) {
+    bytes /= 1024;
+    i++;
+  }
+  return bytes.toFixed(i ? 1 : 0) + ' ' + units[i];
+}
+
+function duration(seconds) {
+  const h = Math.floor(seconds / 3600);
+  const m = Math.floor(seconds % 3600 / 60);
+  return h + 'h' + String(m).padStart(2, '0');
+}
+
+// Channels
+
+async function loadChannels() {
+  channels = await request('GET', '/playlist');
+  renderGroups();
+  renderChannels();
+}
+
+function renderGroups() {
+  const groups = [...new Set(channels.map((c) => c.group))].sort();
+  const list = document.getElementById('groups');
+  list.replaceChildren(
+    el('li', {class: group === null ? 'active' : '', onclick: () => selectGroup(null)}, 'All channels (' + channels.length + ')'),
+    ...groups.map((g) => el('li', {class: g === group ? 'active' : '', onclick: () => selectGroup(g)},
+      (g || 'No group') + ' (' + channels.filter((c) => c.group === g).length + ')')),
+  );
+}
+
+function selectGroup(g) {
+  group = g;
+  renderGroups();
+  renderChannels();
+}
+
+function renderChannels() {
+  const search = document.getElementById('search').value.toLowerCase();
+  const rows = channels
+    .filter((c) => group === null || c.group === group)
+    .filter((c) => !search || c.name.toLowerCase().includes(search))
+    .map((c) => el('tr', {class: c.disabled ? 'disabled' : ''},
+      el('td', {}, c.logo ? el('img', {src: c.logo, alt: ''}) : ''),
+      el('td', {class: c.override && c.override.name ? 'edited' : ''}, c.name),
+      el('td', {class: c.override && c.override.group ? 'edited' : ''}, c.group),
+      el('td', {}, toggle(c)),
+      el('td', {}, el('button', {onclick: () => edit(c)}, 'Edit')),
+    ));
+  document.getElementById('channel-list').replaceChildren(...rows);
+}
+
+function toggle(c) {
+  const input = el('input', {type: 'checkbox'});
+  input.checked = !c.disabled;
+  input.addEventListener('change', async () => {
+    const o = Object.assign({}, c.override, {disabled: !input.checked});
+    await request('PUT', '/channels/' + c.id, o);
+    await loadChannels();
+  });
+  return input;
+}
+
+function edit(c) {
+  const dialog = document.getElementById('edit');
+  const form = dialog.querySelector('form');
+  const o = c.override || {};
+  form.name.value = o.name || '';
+  form.name.placeholder = c.name;
+  form.logo.value = o.logo || '';
+  form.logo.placeholder = c.logo;
+  form.group.value = o.group || '';
+  form.group.placeholder = c.group;
+
+  dialog.onclose = async () => {
+    switch (dialog.returnValue) {
+      case 'save':
+        await request('PUT', '/channels/' + c.id, {
+          disabled: !!o.disabled,
+          name: form.name.value.trim(),
+          logo: form.logo.value.trim(),
+          group: form.group.value.trim(),
+        });
+        break;
+      case 'reset':
+        await request('DELETE', '/channels/' + c.id);
+        break;
+      default:
+        return;
+    }
+    await loadChannels();
+  };
+  dialog.showModal();
+}
+
+// Sessions
+
+async function loadSessions() {
+  const sessions = await request('GET', '/streams');
+  const now = Date.now();
+
+  // the bitrate is measured between two refreshes, the average is shown first
+  const current = {};
+  const rows = sessions.map((s) => {
+    current[s.id] = {bytes: s.bytes, time: now};
+    let bitrate = s.bitrate;
+    const p = previous[s.id];
+    if (p && now > p.time) {
+      bitrate = (s.bytes - p.bytes) * 8 * 1000 / (now - p.time);
+    }
+
+    return el('tr', {},
+      el('td', {}, s.user || '-'),
+      el('td', {}, s.channel),
+      el('td', {}, s.client),
+      el('td', {}, s.account || '-'),
+      el('td', {}, duration((now - Date.parse(s.started)) / 1000)),
+      el('td', {}, (bitrate / 1000000).toFixed(2) + ' Mb/s'),
+      el('td', {}, el('button', {onclick: () => kill(s.id)}, 'Stop')),
+    );
+  });
+  previous = current;
+
+  document.getElementById('session-list').replaceChildren(...rows);
+}
+
+async function kill(id) {
+  await request('DELETE', '/streams/' + id);
+  await loadSessions();
+}
+
+// Users
+
+async function loadUsers() {
+  const users = await request('GET', '/users');
+  const rows = await Promise.all(users.map(async (u) => {
+    const urls = await request('GET', '/users/' + encodeURIComponent(u.username) + '/urls');
+    const copies = [el('button', {onclick: () => copy(urls.m3u)}, 'M3U')];
+    if (urls.xtream) {
+      copies.push(el('button', {onclick: () => copy(urls.xtream.get)}, 'Xtream'));
+    }
+
+    return el('tr', {},
+      el('td', {}, u.username + (u.admin ? ' (admin)' : '')),
+      el('td', {}, u.disabled ? 'disabled' : (u.expiry ? 'until ' + u.expiry.slice(0, 10) : 'active')),
+      el('td', {}, u.usage.active_streams + (u.max_streams ? ' / ' + u.max_streams : '')),
+      el('td', {}, size(u.usage.day_bytes) + ', ' + duration(u.usage.day_watch_time)),
+      el('td', {}, size(u.usage.month_bytes) + ', ' + duration(u.usage.month_watch_time)),
+      el('td', {}, ...copies),
+    );
+  }));
+
+  document.getElementById('user-list').replaceChildren(...rows);
+}
+
+function copy(text) {
+  if (navigator.clipboard) {
+    navigator.clipboard.writeText(text);
+  } else {
+    window.prompt('Playlist url', text);
+  }
+}
+
+// Tabs
+
+const loaders = {channels: loadChannels, sessions: loadSessions, users: loadUsers};
+let timer = null;
+
+function show() {
+  const tab = location.hash.slice(1) || 'channels';
+  document.querySelectorAll('main section').forEach((s) => s.classList.toggle('active', s.id === tab));
+  document.querySelectorAll('nav a').forEach((a) => a.classList.toggle('active', a.dataset.tab === tab));
+
+  clearInterval(timer);
+  const load = () => loaders[tab]().catch((err) => console.error(err));
+  load();
+  if (tab === 'sessions') {
+    timer = setInterval(load, 2000);
+  }
+}
+
+document.getElementById('search').addEventListener('input', renderChannels);
+window.addEventListener('hashchange', show);
+show();
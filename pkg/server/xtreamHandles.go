@@ -19,30 +19,42 @@
 package server
 
 import (
+	"bytes"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
-	"os"
-	"path/filepath"
+	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/jamesnetherton/m3u"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/playlist"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
 	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
-	uuid "github.com/satori/go.uuid"
+	xtream "github.com/tellytv/go.xtream-codes"
 )
 
+// cacheMeta is a processed playlist, rendered for each user on request,
+// or the response of a player API action.
 type cacheMeta struct {
-	string
+	tracks []m3u.Track
+	resp   interface{}
 	time.Time
 }
 
-var hlsChannelsRedirectURL map[string]url.URL = map[string]url.URL{}
+// hlsRedirect is where an HLS channel has been redirected by its provider.
+type hlsRedirect struct {
+	url.URL
+	provider *xtreamProvider
+}
+
+var hlsChannelsRedirectURL map[string]hlsRedirect = map[string]hlsRedirect{}
 var hlsChannelsRedirectURLLock = sync.RWMutex{}
 
 // XXX Use key/value storage e.g: etcd, redis...
@@ -50,39 +62,34 @@ var hlsChannelsRedirectURLLock = sync.RWMutex{}
 var xtreamM3uCache map[string]cacheMeta = map[string]cacheMeta{}
 var xtreamM3uCacheLock = sync.RWMutex{}
 
-func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string) error {
+// cacheXtreamM3u process an Xtream playlist, its live tracks numbered by channel, and cache it.
+func (c *Config) cacheXtreamM3u(playlist *m3u.Playlist, cacheName string, numbers map[string]int) error {
 	xtreamM3uCacheLock.Lock()
 	defer xtreamM3uCacheLock.Unlock()
 
-	tmp := *c
-	tmp.playlist = playlist
-
-	path := filepath.Join(os.TempDir(), uuid.NewV4().String()+".iptv-proxy.m3u")
-	f, err := os.Create(path)
+	tracks, _, _, err := c.processPlaylist(playlist.Tracks, true)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-
-	if err := tmp.marshallInto(f, true); err != nil {
-		return err
-	}
-	xtreamM3uCache[cacheName] = cacheMeta{path, time.Now()}
+	c.numberXtreamTracks(tracks, numbers)
+	xtreamM3uCache[cacheName] = cacheMeta{tracks: tracks, Time: time.Now()}
 
 	return nil
 }
 
-func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Playlist, error) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
-	if err != nil {
-		return nil, err
-	}
+// serveXtreamM3u render a cached playlist for the request user.
+func (c *Config) serveXtreamM3u(ctx *gin.Context, cacheName string) {
+	xtreamM3uCacheLock.RLock()
+	tracks := xtreamM3uCache[cacheName].tracks
+	xtreamM3uCacheLock.RUnlock()
 
-	cat, err := client.GetLiveCategories()
-	if err != nil {
-		return nil, err
-	}
+	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
+	ctx.Header("Content-Type", "application/octet-stream")
+
+	c.marshallInto(ctx.Writer, tracks, nil, requestUser(ctx), true)
+}
 
+func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Playlist, error) {
 	// this is specific to xtream API,
 	// prefix with "live" if there is an extension.
 	var prefix string
@@ -94,37 +101,55 @@ func (c *Config) xtreamGenerateM3u(ctx *gin.Context, extension string) (*m3u.Pla
 	var playlist = new(m3u.Playlist)
 	playlist.Tracks = make([]m3u.Track, 0)
 
-	for _, category := range cat {
-		live, err := client.GetLiveStreams(fmt.Sprint(category.ID))
+	for _, provider := range c.xtreamProviders {
+		client, err := provider.client(ctx.Request.UserAgent())
 		if err != nil {
 			return nil, err
 		}
 
-		for _, stream := range live {
-			track := m3u.Track{Name: stream.Name, Length: -1, URI: "", Tags: nil}
+		cat, err := client.GetLiveCategories()
+		if err != nil {
+			return nil, err
+		}
 
-			//TODO: Add more tag if needed.
-			if stream.EPGChannelID != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-id", Value: stream.EPGChannelID})
-			}
-			if stream.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: stream.Name})
-			}
-			if stream.Icon != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: stream.Icon})
-			}
-			if category.Name != "" {
-				track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category.Name})
+		for _, category := range cat {
+			live, err := client.GetLiveStreams(fmt.Sprint(category.ID))
+			if err != nil {
+				return nil, err
 			}
 
-			track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", c.XtreamBaseURL, prefix, c.XtreamUser, c.XtreamPassword, fmt.Sprint(stream.ID), extension)
-			playlist.Tracks = append(playlist.Tracks, track)
+			for _, stream := range live {
+				track := streamTrack(&stream, category.Name)
+				track.URI = fmt.Sprintf("%s/%s%s/%s/%s%s", provider.BaseURL, prefix, provider.User, provider.Password, fmt.Sprint(stream.ID), extension)
+				playlist.Tracks = append(playlist.Tracks, track)
+			}
 		}
 	}
 
 	return playlist, nil
 }
 
+// streamTrack return the playlist track of an xtream live stream, without its URI.
+func streamTrack(stream *xtream.Stream, category string) m3u.Track {
+	track := m3u.Track{Name: stream.Name, Length: -1, URI: "", Tags: nil}
+
+	//TODO: Add more tag if needed.
+	if stream.EPGChannelID != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-id", Value: stream.EPGChannelID})
+	}
+	if stream.Name != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-name", Value: stream.Name})
+	}
+	if stream.Icon != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "tvg-logo", Value: stream.Icon})
+	}
+	if category != "" {
+		track.Tags = append(track.Tags, m3u.Tag{Name: "group-title", Value: category})
+	}
+
+	return track
+}
+
 func (c *Config) xtreamGetAuto(ctx *gin.Context) {
 	newQuery := ctx.Request.URL.Query()
 	q := c.RemoteURL.Query()
@@ -141,7 +166,7 @@ func (c *Config) xtreamGetAuto(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamGet(ctx *gin.Context) {
-	rawURL := fmt.Sprintf("%s/get.php?username=%s&password=%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword)
+	var query string
 
 	q := ctx.Request.URL.Query()
 
@@ -150,27 +175,46 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 			continue
 		}
 
-		rawURL = fmt.Sprintf("%s&%s=%s", rawURL, k, strings.Join(v, ","))
+		query = fmt.Sprintf("%s&%s=%s", query, k, strings.Join(v, ","))
 	}
 
-	m3uURL, err := url.Parse(rawURL)
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
-		return
+	m3uURLs := make([]string, 0, len(c.xtreamProviders))
+	for _, provider := range c.xtreamProviders {
+		rawURL := fmt.Sprintf("%s/get.php?username=%s&password=%s%s", provider.BaseURL, provider.User, provider.Password, query)
+
+		m3uURL, err := url.Parse(rawURL)
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		m3uURLs = append(m3uURLs, m3uURL.String())
 	}
+	cacheName := strings.Join(m3uURLs, "|")
 
 	xtreamM3uCacheLock.RLock()
-	meta, ok := xtreamM3uCache[m3uURL.String()]
+	meta, ok := xtreamM3uCache[cacheName]
 	d := time.Since(meta.Time)
-	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
-		log.Printf("[iptv-proxy] %v | %s | xtream cache m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
+	hit := ok && d.Hours() < float64(c.M3UCacheExpiration)
+	xtreamCacheRequests.WithLabelValues("get", cacheLabel(hit)).Inc()
+	if !hit {
+		requestLogger(ctx).Info("xtream cache m3u file")
 		xtreamM3uCacheLock.RUnlock()
-		playlist, err := m3u.Parse(m3uURL.String())
+		playlist := new(m3u.Playlist)
+		for i, m3uURL := range m3uURLs {
+			p, err := m3u.Parse(m3uURL)
+			if err != nil {
+				ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+				return
+			}
+			c.xtreamProviders[i].refreshed(false)
+			playlist.Tracks = append(playlist.Tracks, p.Tracks...)
+		}
+		numbers, httpcode, err := c.xtreamChannelNumbers(xtreamProviderClients{c.xtreamProviders, ctx.Request.UserAgent()})
 		if err != nil {
-			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			ctx.AbortWithError(httpcode, err) // nolint: errcheck
 			return
 		}
-		if err := c.cacheXtreamM3u(&playlist, m3uURL.String()); err != nil {
+		if err := c.cacheXtreamM3u(playlist, cacheName, numbers); err != nil {
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
@@ -178,13 +222,7 @@ func (c *Config) xtreamGet(ctx *gin.Context) {
 		xtreamM3uCacheLock.RUnlock()
 	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
-	xtreamM3uCacheLock.RLock()
-	path := xtreamM3uCache[m3uURL.String()].string
-	xtreamM3uCacheLock.RUnlock()
-	ctx.Header("Content-Type", "application/octet-stream")
-
-	ctx.File(path)
+	c.serveXtreamM3u(ctx, cacheName)
 }
 
 func (c *Config) xtreamApiGet(ctx *gin.Context) {
@@ -200,15 +238,25 @@ func (c *Config) xtreamApiGet(ctx *gin.Context) {
 	xtreamM3uCacheLock.RLock()
 	meta, ok := xtreamM3uCache[cacheName]
 	d := time.Since(meta.Time)
-	if !ok || d.Hours() >= float64(c.M3UCacheExpiration) {
-		log.Printf("[iptv-proxy] %v | %s | xtream cache API m3u file\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP())
+	hit := ok && d.Hours() < float64(c.M3UCacheExpiration)
+	xtreamCacheRequests.WithLabelValues(apiGet, cacheLabel(hit)).Inc()
+	if !hit {
+		requestLogger(ctx).Info("xtream cache API m3u file")
 		xtreamM3uCacheLock.RUnlock()
 		playlist, err := c.xtreamGenerateM3u(ctx, extension)
 		if err != nil {
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
-		if err := c.cacheXtreamM3u(playlist, cacheName); err != nil {
+		for _, provider := range c.xtreamProviders {
+			provider.refreshed(false)
+		}
+		numbers, httpcode, err := c.xtreamChannelNumbers(xtreamProviderClients{c.xtreamProviders, ctx.Request.UserAgent()})
+		if err != nil {
+			ctx.AbortWithError(httpcode, err) // nolint: errcheck
+			return
+		}
+		if err := c.cacheXtreamM3u(playlist, cacheName, numbers); err != nil {
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
@@ -216,14 +264,7 @@ func (c *Config) xtreamApiGet(ctx *gin.Context) {
 		xtreamM3uCacheLock.RUnlock()
 	}
 
-	ctx.Header("Content-Disposition", fmt.Sprintf(`attachment; filename=%q`, c.M3UFileName))
-	xtreamM3uCacheLock.RLock()
-	path := xtreamM3uCache[cacheName].string
-	xtreamM3uCacheLock.RUnlock()
-	ctx.Header("Content-Type", "application/octet-stream")
-
-	ctx.File(path)
-
+	c.serveXtreamM3u(ctx, cacheName)
 }
 
 func (c *Config) xtreamPlayerAPIGET(ctx *gin.Context) {
@@ -251,20 +292,60 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 	if len(q["action"]) > 0 {
 		action = q["action"][0]
 	}
+	defer observeXtreamAPI(ctx, action, time.Now())
+
+	providers := xtreamProviderClients{c.xtreamProviders, ctx.Request.UserAgent()}
+	user := requestUser(ctx)
+
+	var lookupID string
+	if lookup, ok := lookupActions[action]; ok && len(q[lookup.param]) > 0 {
+		lookupID = q[lookup.param][0]
+		if !c.xtreamAllowedStream(ctx, providers, lookupID, lookup.streams) {
+			return
+		}
+	}
 
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+	var (
+		resp     interface{}
+		httpcode int
+		err      error
+	)
+	if action == xtreamapi.ActionGetLiveStreams {
+		resp, httpcode, err = c.xtreamLiveStreams(providers, q)
+	} else {
+		resp, httpcode, err = xtreamapi.AggregateAction(c.ProxyConfig, providers, action, q)
+	}
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		ctx.AbortWithError(httpcode, err) // nolint: errcheck
 		return
 	}
 
-	resp, httpcode, err := client.Action(c.ProxyConfig, action, q)
+	if login, ok := resp.(xtreamapi.Login); ok {
+		login.UserInfo.Username = user.Name
+		login.UserInfo.Password = user.Password.String()
+		if c.tokens != nil {
+			login.UserInfo.Password = c.tokens.Sign(user.Name, users.AnyChannel)
+		}
+		if !user.Expiry.IsZero() {
+			login.UserInfo.ExpDate = &xtream.Timestamp{Time: user.Expiry}
+		}
+		login.UserInfo.ActiveConnections = xtream.FlexInt(c.users.Usage(user.Name).ActiveStreams)
+		if user.MaxStreams > 0 {
+			login.UserInfo.MaxConnections = xtream.FlexInt(user.MaxStreams)
+		}
+		resp = login
+	}
+
+	resp, httpcode, err = c.xtreamAllowedCategories(providers, user, action, resp)
 	if err != nil {
 		ctx.AbortWithError(httpcode, err) // nolint: errcheck
 		return
 	}
+	if series, ok := resp.(*xtream.Series); ok && len(user.AllowedGroups) > 0 {
+		c.xtreamRecordEpisodes(providers, lookupID, series)
+	}
 
-	log.Printf("[iptv-proxy] %v | %s |Action\t%s\n", time.Now().Format("2006/01/02 - 15:04:05"), ctx.ClientIP(), action)
+	requestLogger(ctx).Debug("xtream action", "action", action)
 
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
@@ -274,14 +355,376 @@ func (c *Config) xtreamPlayerAPI(ctx *gin.Context, q url.Values) {
 	ctx.JSON(http.StatusOK, resp)
 }
 
-func (c *Config) xtreamXMLTV(ctx *gin.Context) {
-	client, err := xtreamapi.New(c.XtreamUser.String(), c.XtreamPassword.String(), c.XtreamBaseURL, ctx.Request.UserAgent())
+// categoriesActions are the actions listing the categories of the streams listed by an action.
+var categoriesActions = map[string]string{
+	xtreamapi.ActionGetLiveStreams: xtreamapi.ActionGetLiveCategories,
+	xtreamapi.ActionGetVodStreams:  xtreamapi.ActionGetVodCategories,
+	xtreamapi.ActionGetSeries:      xtreamapi.ActionGetSeriesCategories,
+}
+
+// xtreamAllowedCategories remove from an action response the categories,
+// and the streams of the categories, the user isn't allowed to watch.
+func (c *Config) xtreamAllowedCategories(providers xtreamapi.Providers, user *users.User, action string, resp interface{}) (interface{}, int, error) {
+	if len(user.AllowedGroups) == 0 {
+		return resp, 0, nil
+	}
+
+	if categories, ok := resp.([]xtream.Category); ok {
+		res := make([]xtream.Category, 0, len(categories))
+		for _, category := range categories {
+			if user.Allowed(category.Name) {
+				res = append(res, category)
+			}
+		}
+		return res, 0, nil
+	}
+
+	categoriesAction, ok := categoriesActions[action]
+	if !ok {
+		return resp, 0, nil
+	}
+
+	categories, httpcode, err := c.xtreamCachedAction(providers, categoriesAction)
 	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return nil, httpcode, err
+	}
+	allowed := map[xtream.FlexInt]bool{}
+	if l, ok := categories.([]xtream.Category); ok {
+		for _, category := range l {
+			allowed[category.ID] = user.Allowed(category.Name)
+		}
+	}
+
+	switch r := resp.(type) {
+	case []xtream.Stream:
+		res := make([]xtream.Stream, 0, len(r))
+		for _, stream := range r {
+			if allowed[stream.CategoryID] {
+				res = append(res, stream)
+			}
+		}
+		return res, 0, nil
+	case []xtream.SeriesInfo:
+		res := make([]xtream.SeriesInfo, 0, len(r))
+		for _, series := range r {
+			if series.CategoryID != nil && allowed[*series.CategoryID] {
+				res = append(res, series)
+			}
+		}
+		return res, 0, nil
+	}
+
+	return resp, 0, nil
+}
+
+// lookupActions are the actions looking up a stream, with the query parameter
+// of its id and the action listing the streams of its kind.
+var lookupActions = map[string]struct {
+	param   string
+	streams string
+}{
+	xtreamapi.ActionGetVodInfo:         {"vod_id", xtreamapi.ActionGetVodStreams},
+	xtreamapi.ActionGetSeriesInfo:      {"series_id", xtreamapi.ActionGetSeries},
+	xtreamapi.ActionGetShortEPG:        {"stream_id", xtreamapi.ActionGetLiveStreams},
+	xtreamapi.ActionGetSimpleDataTable: {"stream_id", xtreamapi.ActionGetLiveStreams},
+}
+
+// xtreamEpisodes are the categories of the series episodes, recorded when the info
+// of their series is sent to a user limited to some groups: an episode isn't listed
+// by the streams actions and can only be found from its series.
+var xtreamEpisodes = map[string]string{}
+var xtreamEpisodesLock = sync.RWMutex{}
+
+// xtreamRecordEpisodes record the category of the episodes of a series.
+func (c *Config) xtreamRecordEpisodes(providers xtreamapi.Providers, seriesID string, series *xtream.Series) {
+	category, found, _, err := c.xtreamStreamCategory(providers, xtreamapi.ActionGetSeries, seriesID)
+	if err != nil || !found {
+		return
+	}
+
+	xtreamEpisodesLock.Lock()
+	defer xtreamEpisodesLock.Unlock()
+
+	for _, episodes := range series.Episodes {
+		for _, episode := range episodes {
+			xtreamEpisodes[episode.ID] = category
+		}
+	}
+}
+
+// xtreamAllowedStream check the user of the request is allowed to watch the stream id,
+// looking for its category in the streams listed by the actions, and abort the request if not.
+// The get_series_info action stands for the recorded episodes.
+func (c *Config) xtreamAllowedStream(ctx *gin.Context, providers xtreamapi.Providers, id string, actions ...string) bool {
+	user := requestUser(ctx)
+	if len(user.AllowedGroups) == 0 {
+		return true
+	}
+
+	for _, action := range actions {
+		category, found, httpcode, err := c.xtreamStreamCategory(providers, action, id)
+		if err != nil {
+			ctx.AbortWithError(httpcode, err) // nolint: errcheck
+			return false
+		}
+		if !found {
+			continue
+		}
+
+		if !user.Allowed(category) {
+			ctx.AbortWithStatus(http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	ctx.AbortWithStatus(http.StatusForbidden)
+	return false
+}
+
+// xtreamStreamCategory return the category name of a stream id listed by the action.
+func (c *Config) xtreamStreamCategory(providers xtreamapi.Providers, action, id string) (string, bool, int, error) {
+	if action == xtreamapi.ActionGetSeriesInfo {
+		xtreamEpisodesLock.RLock()
+		defer xtreamEpisodesLock.RUnlock()
+		category, found := xtreamEpisodes[id]
+		return category, found, 0, nil
+	}
+
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return "", false, 0, nil
+	}
+
+	streams, httpcode, err := c.xtreamCachedAction(providers, action)
+	if err != nil {
+		return "", false, httpcode, err
+	}
+
+	var (
+		categoryID xtream.FlexInt
+		found      bool
+	)
+	switch l := streams.(type) {
+	case []xtream.Stream:
+		for _, stream := range l {
+			if int64(stream.ID) == n {
+				categoryID, found = stream.CategoryID, true
+				break
+			}
+		}
+	case []xtream.SeriesInfo:
+		for _, series := range l {
+			if int64(series.SeriesID) == n && series.CategoryID != nil {
+				categoryID, found = *series.CategoryID, true
+				break
+			}
+		}
+	}
+	if !found {
+		return "", false, 0, nil
+	}
+
+	categories, httpcode, err := c.xtreamCachedAction(providers, categoriesActions[action])
+	if err != nil {
+		return "", false, httpcode, err
+	}
+	if l, ok := categories.([]xtream.Category); ok {
+		for _, category := range l {
+			if category.ID == categoryID {
+				return category.Name, true, 0, nil
+			}
+		}
+	}
+
+	return "", true, 0, nil
+}
+
+// xtreamCachedAction return the response of an action for all the categories,
+// kept in the Xtream playlists cache for --m3u-cache-expiration hours.
+// The cached responses are shared and must not be modified.
+func (c *Config) xtreamCachedAction(providers xtreamapi.Providers, action string) (interface{}, int, error) {
+	cacheName := "action:" + action
+
+	xtreamM3uCacheLock.RLock()
+	meta, ok := xtreamM3uCache[cacheName]
+	xtreamM3uCacheLock.RUnlock()
+	hit := ok && time.Since(meta.Time).Hours() < float64(c.M3UCacheExpiration)
+	xtreamCacheRequests.WithLabelValues(action, cacheLabel(hit)).Inc()
+	if hit {
+		return meta.resp, http.StatusOK, nil
+	}
+
+	resp, httpcode, err := xtreamapi.AggregateAction(c.ProxyConfig, providers, action, url.Values{})
+	if err != nil {
+		return nil, httpcode, err
+	}
+
+	xtreamM3uCacheLock.Lock()
+	xtreamM3uCache[cacheName] = cacheMeta{resp: resp, Time: time.Now()}
+	xtreamM3uCacheLock.Unlock()
+
+	return resp, httpcode, nil
+}
+
+// xtreamChannels return the live streams of all the categories with the playlist rules
+// applied, in the playlists order, their num set to their channel number.
+// The channels are numbered once, here, so a channel has the same number in the
+// get_live_streams num field and in the tvg-chno tag of the Xtream playlists.
+func (c *Config) xtreamChannels(providers xtreamapi.Providers) ([]xtream.Stream, int, error) {
+	categories, httpcode, err := c.xtreamCachedAction(providers, xtreamapi.ActionGetLiveCategories)
+	if err != nil {
+		return nil, httpcode, err
+	}
+	categoryNames := map[xtream.FlexInt]string{}
+	if l, ok := categories.([]xtream.Category); ok {
+		for _, category := range l {
+			categoryNames[category.ID] = category.Name
+		}
+	}
+
+	resp, httpcode, err := c.xtreamCachedAction(providers, xtreamapi.ActionGetLiveStreams)
+	if err != nil {
+		return nil, httpcode, err
+	}
+	streams, _ := resp.([]xtream.Stream)
+
+	kept := make([]xtream.Stream, 0, len(streams))
+	tracks := make([]m3u.Track, 0, len(streams))
+	for i := range streams {
+		track := streamTrack(&streams[i], categoryNames[streams[i].CategoryID])
+		if !c.filter.Keep(&track) {
+			continue
+		}
+		kept = append(kept, streams[i])
+		tracks = append(tracks, track)
+	}
+
+	keep, _ := c.dedup.Groups(tracks)
+	deduped := make([]xtream.Stream, 0, len(keep))
+	dedupedTracks := make([]m3u.Track, 0, len(keep))
+	for _, i := range keep {
+		deduped = append(deduped, kept[i])
+		dedupedTracks = append(dedupedTracks, tracks[i])
+	}
+	kept, tracks = deduped, dedupedTracks
+
+	tracks = c.rewriter.Apply(tracks)
+	tracks, order := c.orderer.Sort(tracks)
+	numbers := c.orderer.ChannelNumbers(tracks)
+
+	res := make([]xtream.Stream, 0, len(tracks))
+	for i, j := range order {
+		stream := kept[j]
+		stream.Name = tracks[i].Name
+		if logo := playlist.Field(&tracks[i], "tvg-logo"); logo != "" {
+			stream.Icon = logo
+		}
+		stream.Number = xtream.FlexInt(numbers[i])
+		res = append(res, stream)
+	}
+
+	return res, http.StatusOK, nil
+}
+
+// xtreamLiveStreams return the channels of the requested category, or all of them.
+func (c *Config) xtreamLiveStreams(providers xtreamapi.Providers, q url.Values) (interface{}, int, error) {
+	channels, httpcode, err := c.xtreamChannels(providers)
+	if err != nil {
+		return nil, httpcode, err
+	}
+
+	categoryID := q.Get("category_id")
+	if categoryID == "" {
+		return channels, httpcode, nil
+	}
+
+	res := make([]xtream.Stream, 0, len(channels))
+	for _, channel := range channels {
+		if fmt.Sprint(channel.CategoryID) == categoryID {
+			res = append(res, channel)
+		}
+	}
+
+	return res, httpcode, nil
+}
+
+// xtreamChannelNumbers return the channel numbers by live stream id.
+func (c *Config) xtreamChannelNumbers(providers xtreamapi.Providers) (map[string]int, int, error) {
+	channels, httpcode, err := c.xtreamChannels(providers)
+	if err != nil {
+		return nil, httpcode, err
+	}
+
+	numbers := make(map[string]int, len(channels))
+	for _, channel := range channels {
+		numbers[fmt.Sprint(channel.ID)] = int(channel.Number)
+	}
+
+	return numbers, httpcode, nil
+}
+
+// numberXtreamTracks set the tvg-chno tag of the live tracks of an Xtream playlist
+// to the number of their channel.
+func (c *Config) numberXtreamTracks(tracks []m3u.Track, numbers map[string]int) {
+	for i := range tracks {
+		u, err := url.Parse(tracks[i].URI)
+		if err != nil || strings.Contains(u.Path, "/movie/") || strings.Contains(u.Path, "/series/") {
+			continue
+		}
+		p := c.xtreamProviderOf(u)
+		if p == nil {
+			continue
+		}
+
+		name := strings.SplitN(path.Base(u.Path), ".", 2)[0]
+		id, err := xtreamapi.EncodeStringID(len(c.xtreamProviders), p.index, name)
+		if err != nil {
+			continue
+		}
+		n, ok := numbers[id]
+		if !ok {
+			continue
+		}
+
+		tracks[i].Tags = append([]m3u.Tag(nil), tracks[i].Tags...)
+		playlist.SetField(&tracks[i], playlist.ChannelNumberTag, strconv.Itoa(n))
+	}
+}
+
+func (c *Config) xtreamXMLTV(ctx *gin.Context) {
+	guides := make([][]byte, 0, len(c.xtreamProviders)+len(c.EPGSources))
+	for _, provider := range c.xtreamProviders {
+		client, err := provider.client(ctx.Request.UserAgent())
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+
+		resp, err := client.GetXMLTV()
+		if err != nil {
+			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+			return
+		}
+		provider.refreshed(true)
+		guides = append(guides, resp)
+	}
+
+	for _, source := range c.EPGSources {
+		guide, err := fetchEPG(ctx.Request.Context(), source)
+		if err != nil {
+			ctx.AbortWithError(http.StatusBadGateway, fmt.Errorf("epg source %s: %v", source.Name, err)) // nolint: errcheck
+			return
+		}
+		guides = append(guides, guide)
+	}
+
+	if len(guides) == 1 {
+		ctx.Data(http.StatusOK, "application/xml", guides[0])
 		return
 	}
 
-	resp, err := client.GetXMLTV()
+	resp, err := mergeXMLTV(guides)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -290,11 +733,72 @@ func (c *Config) xtreamXMLTV(ctx *gin.Context) {
 	ctx.Data(http.StatusOK, "application/xml", resp)
 }
 
-func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
+type xmltv struct {
+	XMLName xml.Name   `xml:"tv"`
+	Attrs   []xml.Attr `xml:",any,attr"`
+	Inner   []byte     `xml:",innerxml"`
+}
+
+// mergeXMLTV concatenate the channels and programmes of several XMLTV guides.
+func mergeXMLTV(guides [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header) // nolint: errcheck
+
+	for i, guide := range guides {
+		var tv xmltv
+		if err := xml.Unmarshal(guide, &tv); err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			buf.WriteString("<tv") // nolint: errcheck
+			for _, attr := range tv.Attrs {
+				buf.WriteString(fmt.Sprintf(" %s=%q", attr.Name.Local, attr.Value)) // nolint: errcheck
+			}
+			buf.WriteString(">") // nolint: errcheck
+		}
+		buf.Write(tv.Inner) // nolint: errcheck
+	}
+	buf.WriteString("</tv>\n") // nolint: errcheck
+
+	return buf.Bytes(), nil
+}
+
+// streamsActions are the actions listing the streams of each kind of stream urls.
+var streamsActions = map[string][]string{
+	"":          {xtreamapi.ActionGetLiveStreams, xtreamapi.ActionGetVodStreams, xtreamapi.ActionGetSeriesInfo},
+	"live":      {xtreamapi.ActionGetLiveStreams},
+	"timeshift": {xtreamapi.ActionGetLiveStreams},
+	"movie":     {xtreamapi.ActionGetVodStreams},
+	"series":    {xtreamapi.ActionGetSeriesInfo},
+}
+
+// xtreamStreamURL resolve the provider of the requested stream id
+// and return its upstream url, if the user is allowed to watch it.
+func (c *Config) xtreamStreamURL(ctx *gin.Context, kind string, elems ...string) (*url.URL, bool) {
+	provider, id, err := c.xtreamStreamProvider(ctx.Param("id"))
+	if err != nil {
+		ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return nil, false
+	}
+
+	providers := xtreamProviderClients{c.xtreamProviders, ctx.Request.UserAgent()}
+	if !c.xtreamAllowedStream(ctx, providers, strings.SplitN(ctx.Param("id"), ".", 2)[0], streamsActions[kind]...) {
+		return nil, false
+	}
+
+	rpURL, err := provider.streamURL(kind, append(elems, id)...)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+		return nil, false
+	}
+
+	return rpURL, true
+}
+
+func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
+	rpURL, ok := c.xtreamStreamURL(ctx, "")
+	if !ok {
 		return
 	}
 
@@ -302,20 +806,25 @@ func (c *Config) xtreamStreamHandler(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamStreamLive(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/live/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	rpURL, ok := c.xtreamStreamURL(ctx, "live")
+	if !ok {
 		return
 	}
 
-	c.xtreamStream(ctx, rpURL)
+	if strings.HasSuffix(ctx.Param("id"), ".m3u8") {
+		c.hlsXtreamStream(ctx, rpURL)
+		return
+	}
+
+	c.liveStream(ctx, rpURL)
 }
 
+// xtreamStreamPlay proxy "play" tokens which don't identify their provider,
+// they are sent to the first one.
 func (c *Config) xtreamStreamPlay(ctx *gin.Context) {
 	token := ctx.Param("token")
 	t := ctx.Param("type")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/play/%s/%s", c.XtreamBaseURL, token, t))
+	rpURL, err := url.Parse(fmt.Sprintf("%s/play/%s/%s", c.xtreamProviders[0].BaseURL, token, t))
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -325,12 +834,8 @@ func (c *Config) xtreamStreamPlay(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
-	duration := ctx.Param("duration")
-	start := ctx.Param("start")
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/timeshift/%s/%s/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, duration, start, id))
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	rpURL, ok := c.xtreamStreamURL(ctx, "timeshift", ctx.Param("duration"), ctx.Param("start"))
+	if !ok {
 		return
 	}
 
@@ -338,10 +843,8 @@ func (c *Config) xtreamStreamTimeshift(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/movie/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	rpURL, ok := c.xtreamStreamURL(ctx, "movie")
+	if !ok {
 		return
 	}
 
@@ -349,10 +852,8 @@ func (c *Config) xtreamStreamMovie(ctx *gin.Context) {
 }
 
 func (c *Config) xtreamStreamSeries(ctx *gin.Context) {
-	id := ctx.Param("id")
-	rpURL, err := url.Parse(fmt.Sprintf("%s/series/%s/%s/%s", c.XtreamBaseURL, c.XtreamUser, c.XtreamPassword, id))
-	if err != nil {
-		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
+	rpURL, ok := c.xtreamStreamURL(ctx, "series")
+	if !ok {
 		return
 	}
 
@@ -371,17 +872,27 @@ func (c *Config) xtreamHlsStream(ctx *gin.Context) {
 	}
 	channel := s[0]
 
-	url, err := getHlsRedirectURL(channel)
+	redirect, err := getHlsRedirectURL(channel)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
 	}
 
+	id, err := xtreamapi.EncodeStringID(len(c.xtreamProviders), redirect.provider.index, channel)
+	if err != nil {
+		ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+		return
+	}
+	providers := xtreamProviderClients{c.xtreamProviders, ctx.Request.UserAgent()}
+	if !c.xtreamAllowedStream(ctx, providers, id, xtreamapi.ActionGetLiveStreams) {
+		return
+	}
+
 	req, err := url.Parse(
 		fmt.Sprintf(
 			"%s://%s/hls/%s/%s",
-			url.Scheme,
-			url.Host,
+			redirect.Scheme,
+			redirect.Host,
 			ctx.Param("token"),
 			ctx.Param("chunk"),
 		),
@@ -398,7 +909,7 @@ func (c *Config) xtreamHlsStream(ctx *gin.Context) {
 func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
 	channel := ctx.Param("channel")
 
-	url, err := getHlsRedirectURL(channel)
+	redirect, err := getHlsRedirectURL(channel)
 	if err != nil {
 		ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 		return
@@ -407,11 +918,11 @@ func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
 	req, err := url.Parse(
 		fmt.Sprintf(
 			"%s://%s/hlsr/%s/%s/%s/%s/%s/%s",
-			url.Scheme,
-			url.Host,
+			redirect.Scheme,
+			redirect.Host,
 			ctx.Param("token"),
-			c.XtreamUser,
-			c.XtreamPassword,
+			redirect.provider.User,
+			redirect.provider.Password,
 			ctx.Param("channel"),
 			ctx.Param("hash"),
 			ctx.Param("chunk"),
@@ -426,16 +937,16 @@ func (c *Config) xtreamHlsrStream(ctx *gin.Context) {
 	c.xtreamStream(ctx, req)
 }
 
-func getHlsRedirectURL(channel string) (*url.URL, error) {
+func getHlsRedirectURL(channel string) (*hlsRedirect, error) {
 	hlsChannelsRedirectURLLock.RLock()
 	defer hlsChannelsRedirectURLLock.RUnlock()
 
-	url, ok := hlsChannelsRedirectURL[channel+".m3u8"]
+	redirect, ok := hlsChannelsRedirectURL[channel+".m3u8"]
 	if !ok {
 		return nil, errors.New("HSL redirect url not found")
 	}
 
-	return &url, nil
+	return &redirect, nil
 }
 
 func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
@@ -466,10 +977,14 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 			ctx.AbortWithError(http.StatusInternalServerError, err) // nolint: errcheck
 			return
 		}
-		id := ctx.Param("id")
+		provider, id, err := c.xtreamStreamProvider(ctx.Param("id"))
+		if err != nil {
+			ctx.AbortWithError(http.StatusNotFound, err) // nolint: errcheck
+			return
+		}
 		if strings.Contains(location.String(), id) {
 			hlsChannelsRedirectURLLock.Lock()
-			hlsChannelsRedirectURL[id] = *location
+			hlsChannelsRedirectURL[id] = hlsRedirect{*location, provider}
 			hlsChannelsRedirectURLLock.Unlock()
 
 			hlsReq, err := http.NewRequest("GET", location.String(), nil)
@@ -493,7 +1008,10 @@ func (c *Config) hlsXtreamStream(ctx *gin.Context, oriURL *url.URL) {
 				return
 			}
 			body := string(b)
-			body = strings.ReplaceAll(body, "/"+c.XtreamUser.String()+"/"+c.XtreamPassword.String()+"/", "/"+c.User.String()+"/"+c.Password.String()+"/")
+			// the segments urls carry a token of the served channel only
+			user := requestUser(ctx)
+			channel := strings.SplitN(id, ".", 2)[0]
+			body = strings.ReplaceAll(body, "/"+provider.User.String()+"/"+provider.Password.String()+"/", "/"+url.PathEscape(user.Name)+"/"+c.streamPassword(user, channel)+"/")
 
 			mergeHttpHeader(ctx.Writer.Header(), hlsResp.Header)
 
@@ -0,0 +1,243 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/logger"
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/users"
+	xtreamapi "github.com/pierre-emmanuelJ/iptv-proxy/pkg/xtream-proxy"
+)
+
+// xtreamProvider is an upstream Xtream-code service.
+// Its index in the configuration defines its ids range.
+type xtreamProvider struct {
+	config.XtreamProvider
+	index int
+
+	// connections limit of the account, fetched from the provider,
+	// the fetch is retried after limitBackoff when the login fails
+	limitLock     sync.Mutex
+	limit         int
+	limitFetched  bool
+	limitFetching bool
+	limitRetry    time.Time
+	limitBackoff  time.Duration
+
+	// last successful playlist and EPG downloads
+	refreshLock  sync.Mutex
+	lastPlaylist time.Time
+	lastEPG      time.Time
+}
+
+// Delays before fetching again the connections limit of an account after a failed login.
+const (
+	minLimitBackoff = 30 * time.Second
+	maxLimitBackoff = 30 * time.Minute
+)
+
+func newXtreamProviders(providers []config.XtreamProvider) []*xtreamProvider {
+	res := make([]*xtreamProvider, 0, len(providers))
+	for i := range providers {
+		res = append(res, &xtreamProvider{XtreamProvider: providers[i], index: i})
+	}
+
+	return res
+}
+
+func (p *xtreamProvider) accountName() string {
+	if p.Name != "" {
+		return p.Name
+	}
+
+	return p.BaseURL
+}
+
+// maxConnections return the connections limit of the account, 0 for no limit.
+// Unless configured, it's the max_connections of the provider user info,
+// there is no limit until it's fetched.
+func (p *xtreamProvider) maxConnections() int {
+	if p.MaxConnections < 0 {
+		return 0
+	}
+	if p.MaxConnections > 0 {
+		return p.MaxConnections
+	}
+
+	p.limitLock.Lock()
+	if p.limitFetched || p.limitFetching || time.Now().Before(p.limitRetry) {
+		defer p.limitLock.Unlock()
+		return p.limit
+	}
+	p.limitFetching = true
+	p.limitLock.Unlock()
+
+	client, err := p.client("")
+
+	p.limitLock.Lock()
+	defer p.limitLock.Unlock()
+
+	p.limitFetching = false
+	if err != nil {
+		p.limitBackoff *= 2
+		switch {
+		case p.limitBackoff < minLimitBackoff:
+			p.limitBackoff = minLimitBackoff
+		case p.limitBackoff > maxLimitBackoff:
+			p.limitBackoff = maxLimitBackoff
+		}
+		p.limitRetry = time.Now().Add(p.limitBackoff)
+		logger.Error("provider max connections", "provider", p.accountName(), "error", err, "retry_in", p.limitBackoff)
+		return p.limit
+	}
+	p.limit = int(client.UserInfo.MaxConnections)
+	p.limitFetched = true
+
+	return p.limit
+}
+
+// refreshed record a successful download of the playlist or of the EPG.
+func (p *xtreamProvider) refreshed(epg bool) {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	if epg {
+		p.lastEPG = time.Now()
+	} else {
+		p.lastPlaylist = time.Now()
+	}
+}
+
+func (p *xtreamProvider) lastRefreshes() (playlist, epg time.Time) {
+	p.refreshLock.Lock()
+	defer p.refreshLock.Unlock()
+
+	return p.lastPlaylist, p.lastEPG
+}
+
+func (p *xtreamProvider) client(userAgent string) (*xtreamapi.Client, error) {
+	return xtreamapi.New(p.User.String(), p.Password.String(), p.BaseURL, userAgent)
+}
+
+// streamURL return the upstream url of a stream e.g: "<base url>/live/<user>/<password>/<id>".
+func (p *xtreamProvider) streamURL(kind string, elems ...string) (*url.URL, error) {
+	parts := []string{p.BaseURL}
+	if kind != "" {
+		parts = append(parts, kind)
+	}
+	parts = append(parts, p.User.String(), p.Password.String())
+	parts = append(parts, elems...)
+
+	return url.Parse(strings.Join(parts, "/"))
+}
+
+// xtreamProviderClients gives access to the providers clients for one request.
+type xtreamProviderClients struct {
+	providers []*xtreamProvider
+	userAgent string
+}
+
+func (p xtreamProviderClients) Len() int {
+	return len(p.providers)
+}
+
+func (p xtreamProviderClients) Client(n int) (*xtreamapi.Client, error) {
+	return p.providers[n].client(p.userAgent)
+}
+
+// xtreamStreamProvider resolve the provider of a proxyfied stream id, e.g: "100000042.ts",
+// and return it with the upstream stream id, e.g: "42.ts".
+func (c *Config) xtreamStreamProvider(id string) (*xtreamProvider, string, error) {
+	name, ext := id, ""
+	if i := strings.Index(id, "."); i >= 0 {
+		name, ext = id[:i], id[i:]
+	}
+
+	n, upstreamID, err := xtreamapi.DecodeStringID(len(c.xtreamProviders), name)
+	if err != nil {
+		return nil, "", fmt.Errorf("unknown stream %q: %w", id, err)
+	}
+
+	return c.xtreamProviders[n], upstreamID + ext, nil
+}
+
+// xtreamProxyPath rewrite the path of an upstream stream url for the proxy:
+// the provider credentials are replaced by the user ones and the stream id
+// is moved into the provider ids range.
+func (c *Config) xtreamProxyPath(u *url.URL, user *users.User) (string, error) {
+	uriPath := u.EscapedPath()
+	username := url.PathEscape(user.Name)
+
+	if p := c.xtreamProviderOf(u); p != nil {
+		dir, file := path.Split(uriPath)
+		name, ext := file, ""
+		if i := strings.Index(file, "."); i >= 0 {
+			name, ext = file[:i], file[i:]
+		}
+		id, err := xtreamapi.EncodeStringID(len(c.xtreamProviders), p.index, name)
+		if err != nil {
+			return "", err
+		}
+
+		creds := "/" + p.User.PathEscape() + "/" + p.Password.PathEscape() + "/"
+		proxyCreds := "/" + username + "/" + c.streamPassword(user, id) + "/"
+		dir = strings.Replace(dir, creds, proxyCreds, 1)
+
+		return dir + id + ext, nil
+	}
+
+	if len(c.xtreamProviders) > 0 {
+		p := c.xtreamProviders[0]
+		uriPath = strings.ReplaceAll(uriPath, p.User.PathEscape(), username)
+		channel := strings.SplitN(path.Base(uriPath), ".", 2)[0]
+		uriPath = strings.ReplaceAll(uriPath, p.Password.PathEscape(), c.streamPassword(user, channel))
+	}
+
+	return uriPath, nil
+}
+
+// xtreamProviderOf return the provider whose credentials are in the url path,
+// preferring the one with the same host.
+func (c *Config) xtreamProviderOf(u *url.URL) *xtreamProvider {
+	uriPath := u.EscapedPath()
+
+	var found *xtreamProvider
+	for _, p := range c.xtreamProviders {
+		if !strings.Contains(uriPath, "/"+p.User.PathEscape()+"/"+p.Password.PathEscape()+"/") {
+			continue
+		}
+
+		base, err := url.Parse(p.BaseURL)
+		if err == nil && base.Host == u.Host {
+			return p
+		}
+		if found == nil {
+			found = p
+		}
+	}
+
+	return found
+}
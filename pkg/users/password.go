@@ -0,0 +1,181 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package users
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hash algorithms.
+const (
+	Bcrypt = "bcrypt"
+	Argon2 = "argon2"
+)
+
+// argon2id parameters of the generated hashes.
+const (
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+// bcryptSaltKeyLen is the length of the encoded salt and key ending a bcrypt hash.
+const bcryptSaltKeyLen = 22 + 31
+
+// HashPassword hash a password with the bcrypt or argon2 (argon2id) algorithm.
+func HashPassword(password, algorithm string) (string, error) {
+	switch algorithm {
+	case "", Bcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case Argon2:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	default:
+		return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+	}
+}
+
+// IsHash tell if a stored password is a bcrypt or argon2id hash.
+func IsHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$") || strings.HasPrefix(stored, "$argon2id$")
+}
+
+// checkPassword compare a password to a stored one, hashed or in plain text, in constant time.
+func checkPassword(stored, password string) bool {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		return checkArgon2(stored, password)
+	case IsHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	default:
+		return subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	}
+}
+
+// argon2Params is a parsed argon2id hash.
+type argon2Params struct {
+	memory, time uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+// parseArgon2 parse a hash in the PHC format:
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<key>
+func parseArgon2(stored string) (*argon2Params, error) {
+	parts := strings.Split(stored, "$")
+	if len(parts) != 6 {
+		return nil, errors.New("invalid argon2id hash format")
+	}
+
+	var (
+		h       argon2Params
+		version int
+	)
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+	// argon2.IDKey panics on a zero time or threads
+	if h.memory == 0 || h.time == 0 || h.threads == 0 {
+		return nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	var err error
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+	if len(h.key) == 0 {
+		return nil, errors.New("empty argon2id key")
+	}
+
+	return &h, nil
+}
+
+// validateHash check that a stored hash can be compared to the passwords.
+func validateHash(stored string) error {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		_, err := parseArgon2(stored)
+		return err
+	case IsHash(stored):
+		_, err := bcrypt.Cost([]byte(stored))
+		return err
+	default:
+		return nil
+	}
+}
+
+// checkArgon2 compare a password to an argon2id hash.
+func checkArgon2(stored, password string) bool {
+	h, err := parseArgon2(stored)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), h.salt, h.time, h.memory, h.threads, uint32(len(h.key)))
+
+	return subtle.ConstantTimeCompare(h.key, other) == 1
+}
+
+// dummyPassword return a stored password of the same kind and cost as the given one,
+// its salt and key zeroed, to be compared when the user doesn't exist so the response
+// time doesn't tell whether a username exists.
+func dummyPassword(stored string) string {
+	switch {
+	case strings.HasPrefix(stored, "$argon2id$"):
+		parts := strings.Split(stored, "$")
+		if len(parts) != 6 {
+			return "iptv-proxy"
+		}
+		parts[4] = strings.Repeat("A", len(parts[4]))
+		parts[5] = strings.Repeat("A", len(parts[5]))
+
+		return strings.Join(parts, "$")
+	case IsHash(stored) && len(stored) > bcryptSaltKeyLen:
+		// the salt and the key are in the bcrypt base64 alphabet starting with '.'
+		return stored[:len(stored)-bcryptSaltKeyLen] + strings.Repeat(".", bcryptSaltKeyLen)
+	default:
+		return "iptv-proxy"
+	}
+}
@@ -0,0 +1,174 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package users
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Hash return the PHC string of a password, with cheap parameters.
+func argon2Hash(password string, version int) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 1024, 1, 32)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=1024,t=1,p=1$%s$%s", version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func TestCheckPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2Secret := argon2Hash("secret", argon2.Version)
+
+	tests := []struct {
+		name     string
+		stored   string
+		password string
+		want     bool
+	}{
+		{"plain", "secret", "secret", true},
+		{"plain wrong", "secret", "secreT", false},
+		{"plain prefix", "secret", "secre", false},
+		{"plain empty", "secret", "", false},
+		{"bcrypt", string(bcryptHash), "secret", true},
+		{"bcrypt wrong", string(bcryptHash), "other", false},
+		{"bcrypt hash as password", string(bcryptHash), string(bcryptHash), false},
+		{"argon2", argon2Secret, "secret", true},
+		{"argon2 wrong", argon2Secret, "other", false},
+		{"argon2 other version", argon2Hash("secret", 16), "secret", false},
+		{"argon2 missing key", "$argon2id$v=19$m=1024,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg", "secret", false},
+		{"argon2 bad params", "$argon2id$v=19$m=x,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$a2V5", "secret", false},
+		{"argon2 bad salt", "$argon2id$v=19$m=1024,t=1,p=1$!!!$a2V5", "secret", false},
+		{"argon2 bad key", "$argon2id$v=19$m=1024,t=1,p=1$MDEyMzQ1Njc4OWFiY2RlZg$!!!", "secret", false},
+		{"argon2 zero time", "$argon2id$v=19$m=1024,t=0,p=1$MDEyMzQ1Njc4OWFiY2RlZg$a2V5", "secret", false},
+		{"argon2 zero threads", "$argon2id$v=19$m=1024,t=1,p=0$MDEyMzQ1Njc4OWFiY2RlZg$a2V5", "secret", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPassword(tt.stored, tt.password); got != tt.want {
+				t.Errorf("checkPassword() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		wantErr   bool
+	}{
+		{"", false},
+		{Bcrypt, false},
+		{Argon2, false},
+		{"md5", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			hash, err := HashPassword("secret", tt.algorithm)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("HashPassword() = %q, want an error", hash)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !IsHash(hash) {
+				t.Errorf("IsHash(%q) = false, want true", hash)
+			}
+			if !checkPassword(hash, "secret") {
+				t.Errorf("checkPassword(%q, secret) = false, want true", hash)
+			}
+			if checkPassword(hash, "other") {
+				t.Errorf("checkPassword(%q, other) = true, want false", hash)
+			}
+		})
+	}
+}
+
+func TestIsHash(t *testing.T) {
+	tests := []struct {
+		stored string
+		want   bool
+	}{
+		{"$2a$10$abcdefghijklmnopqrstuv", true},
+		{"$2b$10$abcdefghijklmnopqrstuv", true},
+		{"$2y$10$abcdefghijklmnopqrstuv", true},
+		{"$argon2id$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", true},
+		{"$argon2i$v=19$m=1024,t=1,p=1$c2FsdA$a2V5", false},
+		{"secret", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsHash(tt.stored); got != tt.want {
+			t.Errorf("IsHash(%q) = %v, want %v", tt.stored, got, tt.want)
+		}
+	}
+}
+
+func TestDummyPassword(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	argon2Secret := argon2Hash("secret", argon2.Version)
+
+	// the dummy keeps the algorithm and the cost of the stored password
+	tests := []struct {
+		name   string
+		stored string
+		prefix string
+	}{
+		{"plain", "secret", ""},
+		{"bcrypt", string(bcryptHash), string(bcryptHash[:7])},
+		{"argon2", argon2Secret, "$argon2id$v=19$m=1024,t=1,p=1$"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dummy := dummyPassword(tt.stored)
+			if IsHash(dummy) != IsHash(tt.stored) {
+				t.Fatalf("dummyPassword(%q) = %q, not the same kind", tt.stored, dummy)
+			}
+			if err := validateHash(dummy); err != nil {
+				t.Errorf("validateHash(%q) = %v", dummy, err)
+			}
+			if !strings.HasPrefix(dummy, tt.prefix) || len(dummy) != len(tt.stored) && IsHash(dummy) {
+				t.Errorf("dummyPassword(%q) = %q, want a hash starting with %q", tt.stored, dummy, tt.prefix)
+			}
+			if checkPassword(dummy, "secret") {
+				t.Errorf("checkPassword(%q, secret) = true, want false", dummy)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package users
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AnyChannel is the channel of the tokens valid for every channel,
+// they are only accepted by the requests allowing it.
+const AnyChannel = "*"
+
+// ErrInvalidToken is returned for a token badly signed, expired or for another user or channel.
+var ErrInvalidToken = errors.New("invalid token")
+
+var tokenEncoding = base64.RawURLEncoding
+
+// Signer signs the tokens replacing the passwords in the streams urls.
+// A token is bound to a user, a channel and an expiry.
+type Signer struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewSigner return a signer of tokens valid for ttl, a random secret is used when empty.
+func NewSigner(secret string, ttl time.Duration) (*Signer, error) {
+	key := []byte(secret)
+	if secret == "" {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Signer{secret: key, ttl: ttl}, nil
+}
+
+// Sign return a token of the user for a channel, or AnyChannel.
+func (s *Signer) Sign(user, channel string) string {
+	payload := strings.Join([]string{user, channel, strconv.FormatInt(time.Now().Add(s.ttl).Unix(), 10)}, "\x00")
+
+	return tokenEncoding.EncodeToString([]byte(payload)) + "." + tokenEncoding.EncodeToString(s.mac(payload))
+}
+
+// Verify check the token is valid for the user and one of the channels.
+// A token of AnyChannel is only valid when AnyChannel is one of the channels.
+func (s *Signer) Verify(token, user string, channels ...string) error {
+	i := strings.LastIndex(token, ".")
+	if i < 0 {
+		return ErrInvalidToken
+	}
+
+	payload, err := tokenEncoding.DecodeString(token[:i])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	mac, err := tokenEncoding.DecodeString(token[i+1:])
+	if err != nil || !hmac.Equal(mac, s.mac(string(payload))) {
+		return ErrInvalidToken
+	}
+
+	parts := strings.Split(string(payload), "\x00")
+	if len(parts) != 3 || parts[0] != user || !contains(channels, parts[1]) {
+		return ErrInvalidToken
+	}
+
+	expiry, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Signer) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(payload)) // nolint: errcheck
+
+	return h.Sum(nil)[:16]
+}
@@ -0,0 +1,99 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package users
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignerVerify(t *testing.T) {
+	signer, err := NewSigner("secret", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSigner("other", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := NewSigner("secret", -2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	channel := signer.Sign("bob", "1234")
+	wildcard := signer.Sign("bob", AnyChannel)
+
+	tests := []struct {
+		name     string
+		signer   *Signer
+		token    string
+		user     string
+		channels []string
+		valid    bool
+	}{
+		{"channel token", signer, channel, "bob", []string{"1234"}, true},
+		{"channel token where any channel is accepted", signer, channel, "bob", []string{"1234", AnyChannel}, true},
+		{"any channel token", signer, wildcard, "bob", []string{"5678", AnyChannel}, true},
+		{"any channel token for a channel only", signer, wildcard, "bob", []string{"5678"}, false},
+		{"any channel token without channel", signer, wildcard, "bob", nil, false},
+		{"other channel", signer, channel, "bob", []string{"5678", AnyChannel}, false},
+		{"other user", signer, channel, "alice", []string{"1234"}, false},
+		{"other secret", other, channel, "bob", []string{"1234"}, false},
+		{"expired", signer, expired.Sign("bob", "1234"), "bob", []string{"1234"}, false},
+		{"no signature", signer, strings.Split(channel, ".")[0], "bob", []string{"1234"}, false},
+		{"bad signature", signer, channel[:len(channel)-2] + "AA", "bob", []string{"1234"}, false},
+		{"bad encoding", signer, "!!!." + strings.Split(channel, ".")[1], "bob", []string{"1234"}, false},
+		{"forged payload", signer, tokenEncoding.EncodeToString([]byte("bob\x00*\x009999999999")) + "." + strings.Split(channel, ".")[1], "bob", []string{"1234", AnyChannel}, false},
+		{"empty", signer, "", "bob", []string{"1234"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.signer.Verify(tt.token, tt.user, tt.channels...)
+			if tt.valid && err != nil {
+				t.Errorf("Verify() = %v, want nil", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("Verify() = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestSignerRandomSecret(t *testing.T) {
+	a, err := NewSigner("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewSigner("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := a.Sign("bob", "1234")
+	if err := a.Verify(token, "bob", "1234"); err != nil {
+		t.Errorf("Verify() = %v, want nil", err)
+	}
+	if err := b.Verify(token, "bob", "1234"); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Verify() with another random secret = %v, want %v", err, ErrInvalidToken)
+	}
+}
@@ -0,0 +1,323 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// quotaCheckBytes is how many bytes a stream sends between two checks of the quotas.
+const quotaCheckBytes = 1 << 20
+
+// Usage is what a user consumed.
+type Usage struct {
+	ActiveStreams int
+	// Day and Month of the counters, e.g: 2024-01-31 and 2024-01
+	Day, Month     string
+	DayBytes       int64
+	MonthBytes     int64
+	TotalBytes     int64
+	DayWatchTime   time.Duration
+	MonthWatchTime time.Duration
+	TotalWatchTime time.Duration
+}
+
+// usage is guarded by the Store lock.
+type usage struct {
+	Usage
+	streams map[*Stream]struct{}
+	// streams shared by the requests of a session, by key
+	sessions map[string]*Stream
+}
+
+func newUsage() *usage {
+	return &usage{streams: map[*Stream]struct{}{}, sessions: map[string]*Stream{}}
+}
+
+// roll reset the counters of a past day or month.
+func (u *usage) roll(now time.Time) {
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes, u.DayWatchTime = day, 0, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes, u.MonthWatchTime = month, 0, 0
+	}
+}
+
+// add the bytes sent and the watch time of a stream since its last update.
+// An idle session isn't watched since its last request.
+func (u *usage) add(st *Stream, now time.Time) {
+	u.roll(now)
+
+	until := now
+	if st.refs == 0 && st.last.Before(now) {
+		until = st.last
+	}
+
+	bytes := atomic.SwapInt64(&st.bytes, 0)
+	var watch time.Duration
+	if until.After(st.updated) {
+		watch = until.Sub(st.updated)
+		st.updated = until
+	}
+
+	u.DayBytes += bytes
+	u.MonthBytes += bytes
+	u.TotalBytes += bytes
+	u.DayWatchTime += watch
+	u.MonthWatchTime += watch
+	u.TotalWatchTime += watch
+}
+
+// remove a stream which ended.
+func (u *usage) remove(st *Stream) {
+	delete(u.streams, st)
+	if st.key != "" && u.sessions[st.key] == st {
+		delete(u.sessions, st.key)
+	}
+}
+
+// Stream is a stream watched by a user, or a session of requests sharing one stream.
+type Stream struct {
+	store *Store
+	user  string
+	bytes int64
+	// bytes sent since the last check of the quotas
+	unchecked int64
+	updated   time.Time
+
+	// key of the session, empty for a single request
+	key string
+	// requests in progress, guarded by the Store lock
+	refs int
+	// end of the last request, the session ends when idle
+	last time.Time
+	idle time.Duration
+}
+
+// Add count bytes sent to the user, it is safe for concurrent use.
+// It fails once the user exceeded its bandwidth quotas, the stream should be cut.
+func (st *Stream) Add(n int) error {
+	atomic.AddInt64(&st.bytes, int64(n))
+	if atomic.AddInt64(&st.unchecked, int64(n)) < quotaCheckBytes {
+		return nil
+	}
+	atomic.StoreInt64(&st.unchecked, 0)
+
+	st.store.Lock()
+	defer st.store.Unlock()
+
+	user, ok := st.store.users[st.user]
+	if !ok {
+		return ErrInvalidCredentials
+	}
+	u := st.store.usage[st.user]
+	st.store.update(u, time.Now())
+
+	return user.quotaExceeded(u)
+}
+
+// End stop counting the stream, a session ends once idle.
+func (st *Stream) End() {
+	st.store.Lock()
+	defer st.store.Unlock()
+
+	now := time.Now()
+	u := st.store.usage[st.user]
+	u.add(st, now)
+
+	st.refs--
+	st.last = now
+	if st.refs == 0 && st.idle == 0 {
+		u.remove(st)
+	}
+}
+
+// StartStream register a new stream of a user, it fails when the user
+// reached its max streams or its bandwidth quotas.
+func (s *Store) StartStream(name string) (*Stream, error) {
+	return s.JoinStream(name, "", 0)
+}
+
+// JoinStream is StartStream for the requests of a session, e.g: the playlist and segments
+// requests of an HLS channel. The requests with the same key share one stream,
+// which ends when it had no request for idle.
+func (s *Store) JoinStream(name, key string, idle time.Duration) (*Stream, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	user, ok := s.users[name]
+	if !ok {
+		return nil, ErrInvalidCredentials
+	}
+
+	u := s.usage[name]
+	now := time.Now()
+	s.update(u, now)
+
+	if err := user.quotaExceeded(u); err != nil {
+		return nil, err
+	}
+
+	if stream, ok := u.sessions[key]; ok && key != "" {
+		if stream.refs == 0 {
+			stream.updated = now
+		}
+		stream.refs++
+		return stream, nil
+	}
+
+	if user.MaxStreams > 0 && len(u.streams) >= user.MaxStreams {
+		return nil, ErrMaxStreams
+	}
+
+	stream := &Stream{store: s, user: name, updated: now, key: key, refs: 1, idle: idle}
+	u.streams[stream] = struct{}{}
+	if key != "" {
+		u.sessions[key] = stream
+	}
+
+	return stream, nil
+}
+
+// quotaExceeded check the bandwidth quotas of the user, with its usage up to date.
+func (u *User) quotaExceeded(usage *usage) error {
+	if u.DailyQuota > 0 && usage.DayBytes >= u.DailyQuota ||
+		u.MonthlyQuota > 0 && usage.MonthBytes >= u.MonthlyQuota {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// Usage return what a user consumed, including its streams in progress.
+func (s *Store) Usage(name string) Usage {
+	s.Lock()
+	defer s.Unlock()
+
+	u, ok := s.usage[name]
+	if !ok {
+		return Usage{}
+	}
+	s.update(u, time.Now())
+
+	res := u.Usage
+	res.ActiveStreams = len(u.streams)
+
+	return res
+}
+
+// update the counters with the streams in progress and end the idle sessions,
+// it must be called with the lock held.
+func (s *Store) update(u *usage, now time.Time) {
+	u.roll(now)
+	for st := range u.streams {
+		u.add(st, now)
+		if st.refs == 0 && now.Sub(st.last) >= st.idle {
+			u.remove(st)
+		}
+	}
+}
+
+// savedUsage is the usage of a user in the usage file.
+type savedUsage struct {
+	Day            string        `json:"day"`
+	Month          string        `json:"month"`
+	DayBytes       int64         `json:"day_bytes"`
+	MonthBytes     int64         `json:"month_bytes"`
+	TotalBytes     int64         `json:"total_bytes"`
+	DayWatchTime   time.Duration `json:"day_watch_time"`
+	MonthWatchTime time.Duration `json:"month_watch_time"`
+	TotalWatchTime time.Duration `json:"total_watch_time"`
+}
+
+// LoadUsage restore the counters of the users from a file written by SaveUsage,
+// a missing file is ignored.
+func (s *Store) LoadUsage(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved map[string]savedUsage
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return fmt.Errorf("usage file %q: %w", path, err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for name, v := range saved {
+		u, ok := s.usage[name]
+		if !ok {
+			continue
+		}
+		u.Day, u.Month = v.Day, v.Month
+		u.DayBytes, u.MonthBytes, u.TotalBytes = v.DayBytes, v.MonthBytes, v.TotalBytes
+		u.DayWatchTime, u.MonthWatchTime, u.TotalWatchTime = v.DayWatchTime, v.MonthWatchTime, v.TotalWatchTime
+	}
+
+	return nil
+}
+
+// SaveUsage write the counters of the users, with their streams in progress, into a file.
+func (s *Store) SaveUsage(path string) error {
+	s.Lock()
+	saved := make(map[string]savedUsage, len(s.usage))
+	now := time.Now()
+	for name, u := range s.usage {
+		s.update(u, now)
+		saved[name] = savedUsage{
+			Day:            u.Day,
+			Month:          u.Month,
+			DayBytes:       u.DayBytes,
+			MonthBytes:     u.MonthBytes,
+			TotalBytes:     u.TotalBytes,
+			DayWatchTime:   u.DayWatchTime,
+			MonthWatchTime: u.MonthWatchTime,
+			TotalWatchTime: u.TotalWatchTime,
+		}
+	}
+	s.Unlock()
+
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,278 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package users
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+func TestStoreStartStream(t *testing.T) {
+	tests := []struct {
+		name    string
+		account config.UserAccount
+		// streams started before, and the bytes they sent
+		streams int
+		bytes   int
+		ended   bool
+		wantErr error
+	}{
+		{"no limit", config.UserAccount{}, 5, 0, false, nil},
+		{"under the max streams", config.UserAccount{MaxStreams: 2}, 1, 0, false, nil},
+		{"max streams", config.UserAccount{MaxStreams: 2}, 2, 0, false, ErrMaxStreams},
+		{"ended streams", config.UserAccount{MaxStreams: 2}, 2, 0, true, nil},
+		{"under the daily quota", config.UserAccount{DailyQuota: 1}, 1, 1<<20 - 1, false, nil},
+		{"daily quota", config.UserAccount{DailyQuota: 1}, 1, 1 << 20, false, ErrQuotaExceeded},
+		{"daily quota of ended streams", config.UserAccount{DailyQuota: 1}, 1, 1 << 20, true, ErrQuotaExceeded},
+		{"monthly quota", config.UserAccount{MonthlyQuota: 1}, 2, 1 << 19, true, ErrQuotaExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.account.Username, tt.account.Password = "bob", "secret"
+			s, err := NewStore([]config.UserAccount{tt.account})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < tt.streams; i++ {
+				st, err := s.StartStream("bob")
+				if err != nil {
+					t.Fatal(err)
+				}
+				st.Add(tt.bytes)
+				if tt.ended {
+					st.End()
+				}
+			}
+
+			if _, err := s.StartStream("bob"); !errors.Is(err, tt.wantErr) {
+				t.Errorf("StartStream() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	s, err := NewStore(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.StartStream("bob"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("StartStream() of an unknown user = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestStoreUsage(t *testing.T) {
+	s, err := NewStore([]config.UserAccount{{Username: "bob", Password: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := s.StartStream("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.StartStream("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Add(100)
+	b.Add(20)
+	a.End()
+	b.Add(3)
+
+	u := s.Usage("bob")
+	if u.ActiveStreams != 1 {
+		t.Errorf("ActiveStreams = %d, want 1", u.ActiveStreams)
+	}
+	if u.DayBytes != 123 || u.MonthBytes != 123 || u.TotalBytes != 123 {
+		t.Errorf("bytes = %d, %d, %d, want 123", u.DayBytes, u.MonthBytes, u.TotalBytes)
+	}
+	if now := time.Now(); u.Day != now.Format("2006-01-02") || u.Month != now.Format("2006-01") {
+		t.Errorf("Day, Month = %s, %s", u.Day, u.Month)
+	}
+	if u.TotalWatchTime <= 0 {
+		t.Errorf("TotalWatchTime = %v, want > 0", u.TotalWatchTime)
+	}
+
+	if u := s.Usage("alice"); u != (Usage{}) {
+		t.Errorf("Usage() of an unknown user = %+v", u)
+	}
+}
+
+func TestUsageRoll(t *testing.T) {
+	u := newUsage()
+	u.Day, u.Month = "2024-01-31", "2024-01"
+	u.DayBytes, u.MonthBytes, u.TotalBytes = 10, 20, 30
+
+	tests := []struct {
+		name                          string
+		now                           time.Time
+		wantDay, wantMonth, wantTotal int64
+	}{
+		{"same day", time.Date(2024, 1, 31, 23, 0, 0, 0, time.Local), 10, 20, 30},
+		{"next day", time.Date(2024, 2, 1, 0, 0, 0, 0, time.Local), 0, 0, 30},
+	}
+
+	for _, tt := range tests {
+		u.roll(tt.now)
+		if u.DayBytes != tt.wantDay || u.MonthBytes != tt.wantMonth || u.TotalBytes != tt.wantTotal {
+			t.Errorf("%s: bytes = %d, %d, %d, want %d, %d, %d", tt.name,
+				u.DayBytes, u.MonthBytes, u.TotalBytes, tt.wantDay, tt.wantMonth, tt.wantTotal)
+		}
+	}
+}
+
+func TestStreamAddQuota(t *testing.T) {
+	tests := []struct {
+		name    string
+		account config.UserAccount
+		// bytes sent by the stream, in writes of 64KiB
+		bytes   int
+		wantErr error
+	}{
+		{"no quota", config.UserAccount{}, 4 << 20, nil},
+		{"under the daily quota", config.UserAccount{DailyQuota: 2}, 1 << 20, nil},
+		{"daily quota", config.UserAccount{DailyQuota: 2}, 2 << 20, ErrQuotaExceeded},
+		{"monthly quota", config.UserAccount{MonthlyQuota: 1}, 3 << 20, ErrQuotaExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.account.Username, tt.account.Password = "bob", "secret"
+			s, err := NewStore([]config.UserAccount{tt.account})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			st, err := s.StartStream("bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for sent := 0; sent < tt.bytes && err == nil; sent += 64 << 10 {
+				err = st.Add(64 << 10)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Add() = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStoreJoinStream(t *testing.T) {
+	s, err := NewStore([]config.UserAccount{{Username: "bob", Password: "secret", MaxStreams: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the requests of a session share one stream
+	playlist, err := s.JoinStream("bob", "hls:1", 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment, err := s.JoinStream("bob", "hls:1", 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("JoinStream() of the same session = %v", err)
+	}
+	if playlist != segment {
+		t.Error("JoinStream() of the same session returned another stream")
+	}
+	if _, err := s.JoinStream("bob", "hls:2", 50*time.Millisecond); !errors.Is(err, ErrMaxStreams) {
+		t.Errorf("JoinStream() of another session = %v, want %v", err, ErrMaxStreams)
+	}
+	if _, err := s.StartStream("bob"); !errors.Is(err, ErrMaxStreams) {
+		t.Errorf("StartStream() = %v, want %v", err, ErrMaxStreams)
+	}
+
+	// the session is kept between the requests, until idle
+	playlist.Add(10)
+	playlist.End()
+	segment.End()
+	if u := s.Usage("bob"); u.ActiveStreams != 1 || u.TotalBytes != 10 {
+		t.Errorf("Usage() of the ended requests = %d streams, %d bytes, want 1, 10", u.ActiveStreams, u.TotalBytes)
+	}
+	if _, err := s.JoinStream("bob", "hls:2", 50*time.Millisecond); !errors.Is(err, ErrMaxStreams) {
+		t.Errorf("JoinStream() of another session before idle = %v, want %v", err, ErrMaxStreams)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	u := s.Usage("bob")
+	if u.ActiveStreams != 0 {
+		t.Errorf("Usage() of an idle session = %d streams, want 0", u.ActiveStreams)
+	}
+	if u.TotalWatchTime >= 50*time.Millisecond {
+		t.Errorf("TotalWatchTime = %v, an idle session isn't watched", u.TotalWatchTime)
+	}
+	if _, err := s.JoinStream("bob", "hls:2", 50*time.Millisecond); err != nil {
+		t.Errorf("JoinStream() of another session after idle = %v", err)
+	}
+}
+
+func TestStoreSaveLoadUsage(t *testing.T) {
+	accounts := []config.UserAccount{{Username: "bob", Password: "secret"}, {Username: "alice", Password: "secret"}}
+	s, err := NewStore(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := s.StartStream("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Add(123)
+
+	path := filepath.Join(t.TempDir(), "data", "usage.json")
+	if err := s.SaveUsage(path); err != nil {
+		t.Fatal(err)
+	}
+	want := s.Usage("bob")
+
+	restored, err := NewStore(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadUsage(path); err != nil {
+		t.Fatal(err)
+	}
+	got := restored.Usage("bob")
+	if got.TotalBytes != 123 || got.DayBytes != 123 || got.Day != want.Day || got.TotalWatchTime <= 0 {
+		t.Errorf("LoadUsage() = %+v, want %+v", got, want)
+	}
+	if got.ActiveStreams != 0 {
+		t.Errorf("LoadUsage() restored %d streams", got.ActiveStreams)
+	}
+	if u := restored.Usage("alice"); u.TotalBytes != 0 {
+		t.Errorf("LoadUsage() alice = %+v", u)
+	}
+
+	if err := restored.LoadUsage(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("LoadUsage() of a missing file = %v", err)
+	}
+	bad := filepath.Join(t.TempDir(), "bad.json")
+	if err := ioutil.WriteFile(bad, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := restored.LoadUsage(bad); err == nil {
+		t.Error("LoadUsage() of an invalid file, want an error")
+	}
+}
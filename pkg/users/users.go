@@ -0,0 +1,361 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package users implements the accounts of the proxy.
+package users
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+)
+
+// Authentication errors.
+var (
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrDisabled           = errors.New("account disabled")
+	ErrExpired            = errors.New("account expired")
+	ErrMaxStreams         = errors.New("max streams reached")
+	ErrQuotaExceeded      = errors.New("bandwidth quota exceeded")
+)
+
+// Accounts management errors.
+var (
+	ErrUserExists  = errors.New("user already exists")
+	ErrUnknownUser = errors.New("unknown user")
+)
+
+// User is an account of the proxy.
+type User struct {
+	Name     string
+	Password config.CredentialString
+	Disabled bool
+	// Expiry of the account, zero for never
+	Expiry time.Time
+	// AllowedGroups the user can watch, empty for all
+	AllowedGroups []string
+	// MaxStreams the user can watch at the same time, 0 for no limit
+	MaxStreams int
+	// DailyQuota and MonthlyQuota in bytes, 0 for no limit
+	DailyQuota   int64
+	MonthlyQuota int64
+	// Priority of the user streams when the provider connections are preempted
+	Priority int
+	// Admin can use the admin API
+	Admin bool
+}
+
+// Allowed tell if the user can watch the channels of a group.
+func (u *User) Allowed(group string) bool {
+	if len(u.AllowedGroups) == 0 {
+		return true
+	}
+
+	for _, g := range u.AllowedGroups {
+		if strings.EqualFold(g, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Active return why the account can't be used, nil when it can.
+func (u *User) Active(now time.Time) error {
+	if u.Disabled {
+		return ErrDisabled
+	}
+	if !u.Expiry.IsZero() && now.After(u.Expiry) {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+// Store is the set of accounts, it is safe for concurrent use.
+type Store struct {
+	sync.RWMutex
+	users map[string]*User
+	usage map[string]*usage
+	// digest of the last password verified against a hash, by user,
+	// so the streams requests don't compute the hash each time
+	verified map[string][sha256.Size]byte
+	// dummy password compared when the user doesn't exist
+	dummy string
+}
+
+// NewStore build a store from the configured accounts.
+func NewStore(accounts []config.UserAccount) (*Store, error) {
+	s := &Store{
+		users:    make(map[string]*User, len(accounts)),
+		usage:    make(map[string]*usage, len(accounts)),
+		verified: map[string][sha256.Size]byte{},
+	}
+
+	for i, account := range accounts {
+		if account.Username == "" {
+			return nil, fmt.Errorf("user %d: missing username", i)
+		}
+		if _, ok := s.users[account.Username]; ok {
+			return nil, fmt.Errorf("user %q: duplicated username", account.Username)
+		}
+
+		u, err := newUser(account)
+		if err != nil {
+			return nil, err
+		}
+		s.users[u.Name] = u
+		s.usage[u.Name] = newUsage()
+	}
+	s.updateDummy()
+
+	return s, nil
+}
+
+func newUser(account config.UserAccount) (*User, error) {
+	// an empty password would match the requests without credentials
+	if account.Password == "" {
+		return nil, fmt.Errorf("user %q: missing password", account.Username)
+	}
+
+	if err := validateHash(account.Password.String()); err != nil {
+		return nil, fmt.Errorf("user %q: invalid password hash: %w", account.Username, err)
+	}
+
+	expiry, err := parseExpiry(account.Expiry)
+	if err != nil {
+		return nil, fmt.Errorf("user %q: %w", account.Username, err)
+	}
+
+	return &User{
+		Name:          account.Username,
+		Password:      account.Password,
+		Disabled:      account.Disabled,
+		Expiry:        expiry,
+		AllowedGroups: account.AllowedGroups,
+		MaxStreams:    account.MaxStreams,
+		DailyQuota:    account.DailyQuota << 20,
+		MonthlyQuota:  account.MonthlyQuota << 20,
+		Priority:      account.Priority,
+		Admin:         account.Admin,
+	}, nil
+}
+
+// parseExpiry parse a date, the account expiring at the end of the day, or a RFC 3339 time.
+func parseExpiry(expiry string) (time.Time, error) {
+	if expiry == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.ParseInLocation("2006-01-02", expiry, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Second), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, expiry)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid expiry %q, expected e.g: 2024-12-31", expiry)
+	}
+
+	return t, nil
+}
+
+// updateDummy pick the dummy password of the kind and cost used by most accounts,
+// so an unknown user is rejected in about the time a wrong password takes.
+// The store must be locked.
+func (s *Store) updateDummy() {
+	count := map[string]int{}
+	s.dummy = dummyPassword("")
+	for _, u := range s.users {
+		dummy := dummyPassword(u.Password.String())
+		count[dummy]++
+		if n := count[s.dummy]; count[dummy] > n || count[dummy] == n && dummy < s.dummy {
+			s.dummy = dummy
+		}
+	}
+}
+
+// Authenticate return a copy of the user matching the credentials if the account is active.
+// The stored password can be a bcrypt or argon2id hash, the password of the returned
+// copy is the one given, to be used in the urls generated for the user.
+func (s *Store) Authenticate(name, password string) (User, error) {
+	user, ok := s.Get(name)
+	if !ok {
+		s.RLock()
+		dummy := s.dummy
+		s.RUnlock()
+		checkPassword(dummy, password)
+		return User{}, ErrInvalidCredentials
+	}
+
+	if !s.checkPassword(name, user.Password.String(), password) {
+		return User{}, ErrInvalidCredentials
+	}
+
+	if err := user.Active(time.Now()); err != nil {
+		return User{}, err
+	}
+	user.Password = config.CredentialString(password)
+
+	return user, nil
+}
+
+// checkPassword compare the password of a user to the stored one,
+// remembering the digest of the passwords matching a hash.
+func (s *Store) checkPassword(name, stored, password string) bool {
+	if !IsHash(stored) {
+		return checkPassword(stored, password)
+	}
+
+	digest := sha256.Sum256([]byte(password))
+
+	s.RLock()
+	verified, ok := s.verified[name]
+	s.RUnlock()
+	if ok && subtle.ConstantTimeCompare(verified[:], digest[:]) == 1 {
+		return true
+	}
+
+	if !checkPassword(stored, password) {
+		return false
+	}
+
+	s.Lock()
+	s.verified[name] = digest
+	s.Unlock()
+
+	return true
+}
+
+// AuthenticateToken return a copy of the user of a token valid for one of the channels if the account is active.
+func (s *Store) AuthenticateToken(signer *Signer, name, token string, channels ...string) (User, error) {
+	if err := signer.Verify(token, name, channels...); err != nil {
+		return User{}, err
+	}
+
+	u, ok := s.Get(name)
+	if !ok {
+		return User{}, ErrInvalidCredentials
+	}
+
+	if err := u.Active(time.Now()); err != nil {
+		return User{}, err
+	}
+
+	return u, nil
+}
+
+// Get return a copy of a user.
+func (s *Store) Get(name string) (User, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	u, ok := s.users[name]
+	if !ok {
+		return User{}, false
+	}
+
+	return *u, true
+}
+
+// List return a copy of the users sorted by name.
+func (s *Store) List() []User {
+	s.RLock()
+	defer s.RUnlock()
+
+	res := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		res = append(res, *u)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+
+	return res
+}
+
+// Add create an account.
+func (s *Store) Add(account config.UserAccount) error {
+	if account.Username == "" {
+		return errors.New("missing username")
+	}
+
+	u, err := newUser(account)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.users[u.Name]; ok {
+		return ErrUserExists
+	}
+	s.users[u.Name] = u
+	s.updateDummy()
+	// a removed account keeps its usage
+	if _, ok := s.usage[u.Name]; !ok {
+		s.usage[u.Name] = newUsage()
+	}
+
+	return nil
+}
+
+// Update replace an account, keeping its usage.
+// The password is left unchanged when the account one is empty.
+func (s *Store) Update(account config.UserAccount) error {
+	s.Lock()
+	defer s.Unlock()
+
+	old, ok := s.users[account.Username]
+	if !ok {
+		return ErrUnknownUser
+	}
+	if account.Password == "" {
+		account.Password = old.Password
+	}
+
+	u, err := newUser(account)
+	if err != nil {
+		return err
+	}
+	s.users[u.Name] = u
+	delete(s.verified, u.Name)
+	s.updateDummy()
+
+	return nil
+}
+
+// Remove delete an account, the streams in progress are not stopped.
+func (s *Store) Remove(name string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.users[name]; !ok {
+		return ErrUnknownUser
+	}
+	delete(s.users, name)
+	delete(s.verified, name)
+	s.updateDummy()
+
+	return nil
+}
@@ -0,0 +1,214 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package users
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestStoreAuthenticate(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hashed"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore([]config.UserAccount{
+		{Username: "bob", Password: "secret"},
+		{Username: "alice", Password: config.CredentialString(hash)},
+		{Username: "carol", Password: "secret", Disabled: true},
+		{Username: "dave", Password: "secret", Expiry: "2000-01-01"},
+		{Username: "erin", Password: "secret", Expiry: time.Now().AddDate(0, 0, 1).Format("2006-01-02")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		user     string
+		password string
+		wantErr  error
+	}{
+		{"valid", "bob", "secret", nil},
+		{"wrong password", "bob", "other", ErrInvalidCredentials},
+		{"empty password", "bob", "", ErrInvalidCredentials},
+		{"unknown user", "mallory", "secret", ErrInvalidCredentials},
+		{"hashed password", "alice", "hashed", nil},
+		{"hashed password again", "alice", "hashed", nil},
+		{"wrong hashed password", "alice", "other", ErrInvalidCredentials},
+		{"disabled", "carol", "secret", ErrDisabled},
+		{"expired", "dave", "secret", ErrExpired},
+		{"not expired yet", "erin", "secret", nil},
+		{"wrong password of an expired account", "dave", "other", ErrInvalidCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := s.Authenticate(tt.user, tt.password)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if u.Name != tt.user || u.Password.String() != tt.password {
+				t.Errorf("Authenticate() = %q, %q, want %q, %q", u.Name, u.Password.String(), tt.user, tt.password)
+			}
+		})
+	}
+}
+
+func TestUserAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		groups []string
+		group  string
+		want   bool
+	}{
+		{"all groups", nil, "News", true},
+		{"allowed", []string{"Kids", "News"}, "News", true},
+		{"case insensitive", []string{"news"}, "NEWS", true},
+		{"not allowed", []string{"Kids"}, "News", false},
+		{"no group", []string{"Kids"}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := User{AllowedGroups: tt.groups}
+			if got := u.Allowed(tt.group); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.group, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewStoreErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		accounts []config.UserAccount
+	}{
+		{"missing username", []config.UserAccount{{Password: "secret"}}},
+		{"missing password", []config.UserAccount{{Username: "bob"}}},
+		{"duplicated username", []config.UserAccount{{Username: "bob", Password: "a"}, {Username: "bob", Password: "b"}}},
+		{"invalid expiry", []config.UserAccount{{Username: "bob", Password: "secret", Expiry: "31/12/2024"}}},
+		{"argon2 zero time", []config.UserAccount{{Username: "bob", Password: "$argon2id$v=19$m=1024,t=0,p=1$MDEyMzQ1Njc4OWFiY2RlZg$a2V5"}}},
+		{"argon2 zero threads", []config.UserAccount{{Username: "bob", Password: "$argon2id$v=19$m=1024,t=1,p=0$MDEyMzQ1Njc4OWFiY2RlZg$a2V5"}}},
+		{"bcrypt truncated", []config.UserAccount{{Username: "bob", Password: "$2a$10$abcdefghijklmnopqrstuv"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewStore(tt.accounts); err == nil {
+				t.Error("NewStore(), want an error")
+			}
+		})
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		expiry  string
+		want    time.Time
+		wantErr bool
+	}{
+		{"", time.Time{}, false},
+		{"2024-12-31", time.Date(2024, 12, 31, 23, 59, 59, 0, time.Local), false},
+		{"2024-12-31T12:00:00Z", time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC), false},
+		{"31/12/2024", time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		got, err := parseExpiry(tt.expiry)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseExpiry(%q) = %v, want error %v", tt.expiry, err, tt.wantErr)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseExpiry(%q) = %v, want %v", tt.expiry, got, tt.want)
+		}
+	}
+}
+
+func TestStoreUpdate(t *testing.T) {
+	s, err := NewStore([]config.UserAccount{{Username: "bob", Password: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Add(config.UserAccount{Username: "alice"}); err == nil {
+		t.Error("Add() without password, want an error")
+	}
+	if err := s.Add(config.UserAccount{Username: "bob", Password: "other"}); !errors.Is(err, ErrUserExists) {
+		t.Errorf("Add() of an existing user = %v, want %v", err, ErrUserExists)
+	}
+	if err := s.Update(config.UserAccount{Username: "alice", Password: "secret"}); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("Update() of an unknown user = %v, want %v", err, ErrUnknownUser)
+	}
+
+	// the password is kept when not given
+	if err := s.Update(config.UserAccount{Username: "bob", MaxStreams: 2}); err != nil {
+		t.Fatal(err)
+	}
+	u, err := s.Authenticate("bob", "secret")
+	if err != nil {
+		t.Fatalf("Authenticate() after Update() = %v", err)
+	}
+	if u.MaxStreams != 2 {
+		t.Errorf("MaxStreams = %d, want 2", u.MaxStreams)
+	}
+
+	if err := s.Remove("bob"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Authenticate("bob", "secret"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("Authenticate() after Remove() = %v, want %v", err, ErrInvalidCredentials)
+	}
+}
+
+func TestStoreDummy(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewStore([]config.UserAccount{
+		{Username: "alice", Password: "secret"},
+		{Username: "bob", Password: config.CredentialString(bcryptHash)},
+		{Username: "carol", Password: config.CredentialString(bcryptHash)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := dummyPassword(string(bcryptHash)); s.dummy != want {
+		t.Errorf("dummy = %q, want %q", s.dummy, want)
+	}
+
+	for _, name := range []string{"bob", "carol"} {
+		if err := s.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if IsHash(s.dummy) {
+		t.Errorf("dummy = %q, want a plain text password like the accounts", s.dummy)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/pierre-emmanuelJ/iptv-proxy/pkg/config"
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// Providers gives access to the clients of the aggregated xtream providers.
+type Providers interface {
+	Len() int
+	Client(n int) (*Client, error)
+}
+
+// AggregateAction execute an xtream action on the providers concerned by the request
+// and merge their responses, with the ids moved into each provider ids range.
+func AggregateAction(config *config.ProxyConfig, providers Providers, action string, q url.Values) (respBody interface{}, httpcode int, err error) {
+	switch action {
+	case getLiveCategories, getVodCategories, getSeriesCategories:
+		return aggregate(config, providers, action, q)
+	case getLiveStreams, getVodStreams, getSeries:
+		if len(q["category_id"]) > 0 && q["category_id"][0] != "" {
+			return providerAction(config, providers, action, q, "category_id")
+		}
+		return aggregate(config, providers, action, q)
+	case getVodInfo:
+		return providerAction(config, providers, action, q, "vod_id")
+	case getSerieInfo:
+		return providerAction(config, providers, action, q, "series_id")
+	case getShortEPG, getSimpleDataTable:
+		return providerAction(config, providers, action, q, "stream_id")
+	default:
+		// login on the first provider
+		var client *Client
+		client, err = providers.Client(0)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return client.Action(config, action, q)
+	}
+}
+
+// providerAction execute an action on the provider owning the id in the param query parameter.
+func providerAction(config *config.ProxyConfig, providers Providers, action string, q url.Values, param string) (interface{}, int, error) {
+	if httpcode, err := validateParams(q, param); err != nil {
+		return nil, httpcode, err
+	}
+
+	provider, id, err := DecodeStringID(providers.Len(), q[param][0])
+	if errors.Is(err, ErrIDOutOfRange) {
+		return nil, http.StatusNotFound, fmt.Errorf("unknown %s %q", param, q[param][0])
+	}
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	client, err := providers.Client(provider)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	upstreamQuery := url.Values{}
+	for k, v := range q {
+		upstreamQuery[k] = v
+	}
+	upstreamQuery.Set(param, id)
+
+	resp, httpcode, err := client.Action(config, action, upstreamQuery)
+	if err != nil {
+		return nil, httpcode, err
+	}
+
+	return EncodeIDs(providers.Len(), provider, resp), httpcode, nil
+}
+
+// aggregate execute an action listing items on every provider and concatenate the results.
+// Providers failing are skipped unless they all fail.
+func aggregate(config *config.ProxyConfig, providers Providers, action string, q url.Values) (interface{}, int, error) {
+	var (
+		respBody interface{}
+		httpcode int
+		firstErr error
+	)
+
+	for n := 0; n < providers.Len(); n++ {
+		client, err := providers.Client(n)
+		if err != nil {
+			if firstErr == nil {
+				firstErr, httpcode = err, http.StatusInternalServerError
+			}
+			continue
+		}
+
+		resp, code, err := client.Action(config, action, q)
+		if err != nil {
+			if firstErr == nil {
+				firstErr, httpcode = err, code
+			}
+			continue
+		}
+		respBody = concat(respBody, EncodeIDs(providers.Len(), n, resp))
+	}
+
+	if respBody == nil && firstErr != nil {
+		return nil, httpcode, firstErr
+	}
+
+	return respBody, 0, nil
+}
+
+func concat(a, b interface{}) interface{} {
+	if a == nil {
+		return b
+	}
+
+	switch r := a.(type) {
+	case []xtream.Category:
+		if l, ok := b.([]xtream.Category); ok {
+			return append(r, l...)
+		}
+	case []xtream.Stream:
+		if l, ok := b.([]xtream.Stream); ok {
+			return append(r, l...)
+		}
+	case []xtream.SeriesInfo:
+		if l, ok := b.([]xtream.SeriesInfo); ok {
+			return append(r, l...)
+		}
+	}
+
+	return a
+}
@@ -0,0 +1,174 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+// IDRange is the size of the ids range given to each provider when several are aggregated.
+// Ids of the provider n are moved into [n*IDRange, (n+1)*IDRange),
+// so the first provider keeps its original ids. The upstream ids greater or equal to IDRange
+// can't be moved and are rejected, a single provider keeps all its ids.
+const IDRange = 100000000
+
+// ErrIDOutOfRange is returned for the ids outside of the providers ids ranges.
+var ErrIDOutOfRange = errors.New("id out of the providers ids ranges")
+
+// EncodeID move an upstream id of the provider into its ids range,
+// providers being the number of aggregated providers.
+func EncodeID(providers, provider int, id int64) (int64, error) {
+	if providers <= 1 || id <= 0 {
+		return id, nil
+	}
+	if id >= IDRange {
+		return 0, ErrIDOutOfRange
+	}
+
+	return int64(provider)*IDRange + id, nil
+}
+
+// DecodeID return the provider and the upstream id of a proxy id,
+// providers being the number of aggregated providers.
+func DecodeID(providers int, id int64) (provider int, upstreamID int64, err error) {
+	if providers <= 1 || id <= 0 {
+		return 0, id, nil
+	}
+
+	provider = int(id / IDRange)
+	if provider >= providers {
+		return 0, 0, ErrIDOutOfRange
+	}
+
+	return provider, id % IDRange, nil
+}
+
+// EncodeStringID is EncodeID for ids sent as string, the ids which aren't numbers are kept.
+func EncodeStringID(providers, provider int, id string) (string, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return id, nil
+	}
+
+	encoded, err := EncodeID(providers, provider, n)
+	if err != nil {
+		return "", err
+	}
+
+	return strconv.FormatInt(encoded, 10), nil
+}
+
+// DecodeStringID is DecodeID for ids sent as string.
+func DecodeStringID(providers int, id string) (int, string, error) {
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid id %q", id)
+	}
+
+	provider, upstreamID, err := DecodeID(providers, n)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %q", err, id)
+	}
+
+	return provider, strconv.FormatInt(upstreamID, 10), nil
+}
+
+// EncodeIDs move all the ids of an xtream API response into the provider ids range.
+// The items whose ids are out of range are removed from the lists,
+// and the out of range categories of a single item are cleared.
+func EncodeIDs(providers, provider int, resp interface{}) interface{} {
+	if providers <= 1 {
+		return resp
+	}
+
+	encode := func(id *xtream.FlexInt) bool {
+		n, err := EncodeID(providers, provider, int64(*id))
+		if err != nil {
+			return false
+		}
+		*id = xtream.FlexInt(n)
+		return true
+	}
+	encodeCategory := func(id **xtream.FlexInt) bool {
+		if *id == nil {
+			return true
+		}
+		category := **id
+		if !encode(&category) {
+			return false
+		}
+		*id = &category
+		return true
+	}
+
+	switch r := resp.(type) {
+	case []xtream.Category:
+		categories := r[:0]
+		for _, category := range r {
+			if encode(&category.ID) && encode(&category.Parent) {
+				categories = append(categories, category)
+			}
+		}
+		return categories
+	case []xtream.Stream:
+		streams := r[:0]
+		for _, stream := range r {
+			if encode(&stream.ID) && encode(&stream.CategoryID) {
+				streams = append(streams, stream)
+			}
+		}
+		return streams
+	case []xtream.SeriesInfo:
+		series := r[:0]
+		for _, serie := range r {
+			if encode(&serie.SeriesID) && encodeCategory(&serie.CategoryID) {
+				series = append(series, serie)
+			}
+		}
+		return series
+	case *xtream.VideoOnDemandInfo:
+		encode(&r.MovieData.StreamID)
+		if !encode(&r.MovieData.CategoryID) {
+			r.MovieData.CategoryID = 0
+		}
+	case *xtream.Series:
+		encode(&r.Info.SeriesID)
+		if !encodeCategory(&r.Info.CategoryID) {
+			r.Info.CategoryID = nil
+		}
+		for season := range r.Episodes {
+			episodes := r.Episodes[season][:0]
+			for _, episode := range r.Episodes[season] {
+				id, err := EncodeStringID(providers, provider, episode.ID)
+				if err != nil {
+					continue
+				}
+				episode.ID = id
+				episodes = append(episodes, episode)
+			}
+			r.Episodes[season] = episodes
+		}
+	}
+
+	return resp
+}
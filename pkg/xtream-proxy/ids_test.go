@@ -0,0 +1,181 @@
+/*
+ * Iptv-Proxy is a project to proxyfie an m3u file and to proxyfie an Xtream iptv service (client API).
+ * Copyright (C) 2020  Pierre-Emmanuel Jacquier
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License as published by
+ * the Free Software Foundation, either version 3 of the License, or
+ * (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package xtreamproxy
+
+import (
+	"errors"
+	"testing"
+
+	xtream "github.com/tellytv/go.xtream-codes"
+)
+
+func TestEncodeDecodeID(t *testing.T) {
+	tests := []struct {
+		name         string
+		providers    int
+		provider     int
+		id           int64
+		encoded      int64
+		wantProvider int
+		wantID       int64
+	}{
+		{"first provider keeps its ids", 3, 0, 42, 42, 0, 42},
+		{"second provider", 3, 1, 42, IDRange + 42, 1, 42},
+		{"third provider", 3, 2, 1, 2*IDRange + 1, 2, 1},
+		{"last id of the range", 3, 1, IDRange - 1, 2*IDRange - 1, 1, IDRange - 1},
+		{"zero is kept", 4, 3, 0, 0, 0, 0},
+		{"negative is kept", 4, 3, -1, -1, 0, -1},
+		{"single provider keeps its ids", 1, 0, 42, 42, 0, 42},
+		{"single provider keeps its big ids", 1, 0, IDRange + 7, IDRange + 7, 0, IDRange + 7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := EncodeID(tt.providers, tt.provider, tt.id)
+			if err != nil || encoded != tt.encoded {
+				t.Errorf("EncodeID(%d, %d, %d) = %d, %v, want %d", tt.providers, tt.provider, tt.id, encoded, err, tt.encoded)
+			}
+
+			provider, id, err := DecodeID(tt.providers, encoded)
+			if err != nil || provider != tt.wantProvider || id != tt.wantID {
+				t.Errorf("DecodeID(%d, %d) = %d, %d, %v, want %d, %d", tt.providers, encoded, provider, id, err, tt.wantProvider, tt.wantID)
+			}
+		})
+	}
+}
+
+func TestIDOutOfRange(t *testing.T) {
+	encodes := []struct {
+		name      string
+		providers int
+		provider  int
+		id        int64
+	}{
+		{"first provider", 2, 0, IDRange},
+		{"second provider", 2, 1, IDRange + 7},
+	}
+	for _, tt := range encodes {
+		if got, err := EncodeID(tt.providers, tt.provider, tt.id); !errors.Is(err, ErrIDOutOfRange) {
+			t.Errorf("%s: EncodeID(%d, %d, %d) = %d, %v, want ErrIDOutOfRange", tt.name, tt.providers, tt.provider, tt.id, got, err)
+		}
+	}
+
+	decodes := []struct {
+		name      string
+		providers int
+		id        int64
+	}{
+		{"range of no provider", 2, 2 * IDRange},
+		{"far range", 3, 40 * IDRange},
+	}
+	for _, tt := range decodes {
+		if provider, id, err := DecodeID(tt.providers, tt.id); !errors.Is(err, ErrIDOutOfRange) {
+			t.Errorf("%s: DecodeID(%d, %d) = %d, %d, %v, want ErrIDOutOfRange", tt.name, tt.providers, tt.id, provider, id, err)
+		}
+	}
+}
+
+func TestEncodeDecodeStringID(t *testing.T) {
+	tests := []struct {
+		providers int
+		provider  int
+		id        string
+		encoded   string
+	}{
+		{6, 0, "42", "42"},
+		{6, 1, "42", "100000042"},
+		{6, 5, "99999999", "599999999"},
+		{1, 0, "123456789012", "123456789012"},
+	}
+
+	for _, tt := range tests {
+		encoded, err := EncodeStringID(tt.providers, tt.provider, tt.id)
+		if err != nil || encoded != tt.encoded {
+			t.Errorf("EncodeStringID(%d, %d, %q) = %q, %v, want %q", tt.providers, tt.provider, tt.id, encoded, err, tt.encoded)
+		}
+
+		provider, id, err := DecodeStringID(tt.providers, encoded)
+		if err != nil {
+			t.Fatalf("DecodeStringID(%d, %q) = %v", tt.providers, encoded, err)
+		}
+		if provider != tt.provider || id != tt.id {
+			t.Errorf("DecodeStringID(%d, %q) = %d, %q, want %d, %q", tt.providers, encoded, provider, id, tt.provider, tt.id)
+		}
+	}
+
+	// ids which aren't numbers are kept, and can't be decoded
+	if got, err := EncodeStringID(2, 1, "abc"); err != nil || got != "abc" {
+		t.Errorf("EncodeStringID(2, 1, abc) = %q, %v, want abc", got, err)
+	}
+	for _, id := range []string{"abc", "", "1.5", "99999999999999999999"} {
+		if _, _, err := DecodeStringID(2, id); err == nil {
+			t.Errorf("DecodeStringID(2, %q), want an error", id)
+		}
+	}
+
+	if _, err := EncodeStringID(2, 1, "100000000"); !errors.Is(err, ErrIDOutOfRange) {
+		t.Errorf("EncodeStringID(2, 1, 100000000) = %v, want ErrIDOutOfRange", err)
+	}
+	if _, _, err := DecodeStringID(2, "300000001"); !errors.Is(err, ErrIDOutOfRange) {
+		t.Errorf("DecodeStringID(2, 300000001) = %v, want ErrIDOutOfRange", err)
+	}
+}
+
+func TestEncodeIDs(t *testing.T) {
+	category := xtream.FlexInt(3)
+	streams := []xtream.Stream{{ID: 42, CategoryID: 3}, {ID: IDRange + 1, CategoryID: 3}, {ID: 43, CategoryID: IDRange}}
+	series := []xtream.SeriesInfo{{SeriesID: 7, CategoryID: &category}}
+
+	gotStreams := EncodeIDs(3, 2, streams).([]xtream.Stream)
+	gotSeries := EncodeIDs(3, 2, series).([]xtream.SeriesInfo)
+
+	if len(gotStreams) != 1 {
+		t.Fatalf("EncodeIDs() kept %d streams, want the one in range", len(gotStreams))
+	}
+	if gotStreams[0].ID != 2*IDRange+42 || gotStreams[0].CategoryID != 2*IDRange+3 {
+		t.Errorf("EncodeIDs() stream = %d, category %d", gotStreams[0].ID, gotStreams[0].CategoryID)
+	}
+	if gotSeries[0].SeriesID != 2*IDRange+7 || *gotSeries[0].CategoryID != 2*IDRange+3 {
+		t.Errorf("EncodeIDs() series = %d, category %d", gotSeries[0].SeriesID, *gotSeries[0].CategoryID)
+	}
+	if category != 3 {
+		t.Errorf("EncodeIDs() modified the category of the response, %d", category)
+	}
+
+	// the first provider keeps its ids
+	first := EncodeIDs(3, 0, []xtream.Stream{{ID: 42, CategoryID: 3}}).([]xtream.Stream)
+	if first[0].ID != 42 || first[0].CategoryID != 3 {
+		t.Errorf("EncodeIDs(0) stream = %d, category %d", first[0].ID, first[0].CategoryID)
+	}
+
+	// a single provider keeps all its ids
+	single := EncodeIDs(1, 0, []xtream.Stream{{ID: IDRange + 1, CategoryID: 3}}).([]xtream.Stream)
+	if len(single) != 1 || single[0].ID != IDRange+1 {
+		t.Errorf("EncodeIDs(1, 0) = %v, want the stream unchanged", single)
+	}
+
+	// the out of range episodes are removed
+	serie := &xtream.Series{Episodes: map[string][]xtream.SeriesEpisode{
+		"1": {{ID: "5"}, {ID: "100000005"}},
+	}}
+	EncodeIDs(2, 1, serie)
+	if episodes := serie.Episodes["1"]; len(episodes) != 1 || episodes[0].ID != "100000005" {
+		t.Errorf("EncodeIDs() episodes = %v, want the first one moved", episodes)
+	}
+}
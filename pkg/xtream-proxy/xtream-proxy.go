@@ -42,6 +42,20 @@ const (
 	getSimpleDataTable  = "get_simple_data_table"
 )
 
+// Actions handled specifically by the proxy.
+const (
+	ActionGetLiveCategories   = getLiveCategories
+	ActionGetLiveStreams      = getLiveStreams
+	ActionGetVodCategories    = getVodCategories
+	ActionGetVodStreams       = getVodStreams
+	ActionGetSeriesCategories = getSeriesCategories
+	ActionGetSeries           = getSeries
+	ActionGetVodInfo          = getVodInfo
+	ActionGetSeriesInfo       = getSerieInfo
+	ActionGetShortEPG         = getShortEPG
+	ActionGetSimpleDataTable  = getSimpleDataTable
+)
+
 // Client represent an xtream client
 type Client struct {
 	*xtream.XtreamClient
@@ -57,14 +71,15 @@ func New(user, password, baseURL, userAgent string) (*Client, error) {
 	return &Client{cli}, nil
 }
 
-type login struct {
+// Login is the response of the login action.
+type Login struct {
 	UserInfo   xtream.UserInfo   `json:"user_info"`
 	ServerInfo xtream.ServerInfo `json:"server_info"`
 }
 
 // Login xtream login
-func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int, protocol string) (login, error) {
-	req := login{
+func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int, protocol string) (Login, error) {
+	req := Login{
 		UserInfo: xtream.UserInfo{
 			Username:             proxyUser,
 			Password:             proxyPassword,
@@ -93,6 +108,17 @@ func (c *Client) login(proxyUser, proxyPassword, proxyURL string, proxyPort int,
 	return req, nil
 }
 
+// KnownAction tell if action is one of the Xtream API actions, the empty one being the login.
+func KnownAction(action string) bool {
+	switch action {
+	case getLiveCategories, getLiveStreams, getVodCategories, getVodStreams, getVodInfo,
+		getSeriesCategories, getSeries, getSerieInfo, getShortEPG, getSimpleDataTable:
+		return true
+	}
+
+	return false
+}
+
 // Action execute an xtream action.
 func (c *Client) Action(config *config.ProxyConfig, action string, q url.Values) (respBody interface{}, httpcode int, err error) {
 	protocol := "http"